@@ -7,12 +7,12 @@ toolchain go1.24.2
 require (
 	github.com/aws/aws-sdk-go v1.55.5
 	github.com/mackerelio/go-mackerel-plugin v0.1.5
+	github.com/mackerelio/golib v1.2.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	github.com/mackerelio/golib v1.2.1 // indirect
 	golang.org/x/text v0.21.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
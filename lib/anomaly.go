@@ -0,0 +1,90 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// anomalyBandMetrics are the metrics -anomaly-bands fetches the expected range of.
+var anomalyBandMetrics = []string{"CPUUtilization", "JVMMemoryPressure"}
+
+// anomalyBandWidth is the number of standard deviations of the band.
+const anomalyBandWidth = 2
+
+// fetchAnomalyBands fetches the anomaly detection band of anomalyBandMetrics
+// in one GetMetricData call and stores it as expectedUpper.<metric> and
+// expectedLower.<metric>.
+func (p ESPlugin) fetchAnomalyBands(ctx context.Context, stat map[string]float64) error {
+	types := make(map[string]string)
+	for _, met := range p.metricList() {
+		types[met.Name] = met.Type
+	}
+
+	var queries []*cloudwatch.MetricDataQuery
+	for i, name := range anomalyBandMetrics {
+		t, ok := types[name]
+		if !ok {
+			continue
+		}
+		if o, ok := p.StatOverrides[name]; ok {
+			t = o
+		}
+		queries = append(queries,
+			&cloudwatch.MetricDataQuery{
+				Id: aws.String(fmt.Sprintf("m%d", i)),
+				MetricStat: &cloudwatch.MetricStat{
+					Metric: &cloudwatch.Metric{
+						Namespace:  aws.String(p.nameSpace()),
+						MetricName: aws.String(name),
+						Dimensions: p.dimensions(),
+					},
+					Period: aws.Int64(p.Period),
+					Stat:   aws.String(t),
+				},
+				ReturnData: aws.Bool(false),
+			},
+			&cloudwatch.MetricDataQuery{
+				Id:         aws.String(fmt.Sprintf("band%d", i)),
+				Expression: aws.String(fmt.Sprintf("ANOMALY_DETECTION_BAND(m%d, %d)", i, anomalyBandWidth)),
+			},
+		)
+	}
+	if len(queries) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	out, err := p.CloudWatch.GetMetricDataWithContext(ctx, &cloudwatch.GetMetricDataInput{
+		MetricDataQueries: queries,
+		StartTime:         aws.Time(now.Add(time.Duration(p.Lookback) * time.Second * -1)),
+		EndTime:           aws.Time(now),
+		ScanBy:            aws.String(cloudwatch.ScanByTimestampDescending),
+	})
+	if err != nil {
+		return err
+	}
+
+	// The band comes back as two series under the same id; the higher one is
+	// the upper bound.
+	bounds := make(map[string][]float64)
+	for _, r := range out.MetricDataResults {
+		if len(r.Values) == 0 {
+			continue
+		}
+		id := aws.StringValue(r.Id)
+		bounds[id] = append(bounds[id], aws.Float64Value(r.Values[0]))
+	}
+	for i, name := range anomalyBandMetrics {
+		b := bounds[fmt.Sprintf("band%d", i)]
+		if len(b) != 2 {
+			continue
+		}
+		stat["expectedUpper."+name] = max(b[0], b[1])
+		stat["expectedLower."+name] = min(b[0], b[1])
+	}
+	return nil
+}
@@ -1,15 +1,35 @@
 package mpawselasticsearch
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/opensearchservice"
+	"github.com/aws/aws-sdk-go/service/opensearchservice/opensearchserviceiface"
+	"github.com/aws/aws-sdk-go/service/sts"
 	mp "github.com/mackerelio/go-mackerel-plugin"
 )
 
@@ -19,11 +39,168 @@ const (
 	metricsTypeSum     = "Sum"
 	metricsTypeMaximum = "Maximum"
 	metricsTypeMinimum = "Minimum"
+
+	// maxMetricDataQueries is the number of queries GetMetricData accepts in one call.
+	maxMetricDataQueries = 500
 )
 
 type metrics struct {
 	Name string
 	Type string
+	// Key is the metric key posted to Mackerel when it differs from Name,
+	// e.g. because Name is not a valid key.
+	Key string
+	// Engine limits the metric to domains of that engine when set.
+	Engine string
+	// Window, when set, aggregates the metric over the last Window seconds in
+	// a single period instead of taking the latest datapoint of -period, for
+	// rare events a short lookback misses.
+	Window int64
+	// Period, when set, replaces -period for the metric, e.g. for metrics
+	// published less often than every minute.
+	Period int64
+}
+
+func (m metrics) key() string {
+	if m.Key != "" {
+		return m.Key
+	}
+	return normalizeKey(m.Name)
+}
+
+var defaultMetrics = []metrics{
+	{Name: "ClusterStatus.green", Type: metricsTypeMinimum},
+	{Name: "ClusterStatus.yellow", Type: metricsTypeMaximum},
+	{Name: "ClusterStatus.red", Type: metricsTypeMaximum},
+	{Name: "Nodes", Type: metricsTypeAverage},
+	{Name: "SearchableDocuments", Type: metricsTypeAverage},
+	{Name: "DeletedDocuments", Type: metricsTypeAverage},
+	{Name: "CPUUtilization", Type: metricsTypeMaximum},
+	{Name: "FreeStorageSpace", Type: metricsTypeMinimum},
+	{Name: "ClusterUsedSpace", Type: metricsTypeMinimum},
+	{Name: "ClusterIndexWritesBlocked", Type: metricsTypeMaximum},
+	{Name: "JVMMemoryPressure", Type: metricsTypeMaximum},
+	{Name: "AutomatedSnapshotFailure", Type: metricsTypeSum, Window: 86400},
+	{Name: "KibanaHealthyNodes", Type: metricsTypeMinimum, Engine: engineElasticsearch},
+	{Name: "OpenSearchDashboardsHealthyNodes", Type: metricsTypeMinimum, Engine: engineOpenSearch},
+	{Name: "MasterCPUUtilization", Type: metricsTypeMaximum},
+	{Name: "MasterFreeStorageSpace", Type: metricsTypeMinimum},
+	{Name: "MasterJVMMemoryPressure", Type: metricsTypeMaximum},
+	{Name: "MasterReachableFromNode", Type: metricsTypeMinimum},
+	{Name: "ReadLatency", Type: metricsTypeAverage},
+	{Name: "WriteLatency", Type: metricsTypeAverage},
+	{Name: "ReadThroughput", Type: metricsTypeAverage},
+	{Name: "WriteThroughput", Type: metricsTypeAverage},
+	{Name: "DiskQueueDepth", Type: metricsTypeAverage},
+	{Name: "ReadIOPS", Type: metricsTypeAverage},
+	{Name: "WriteIOPS", Type: metricsTypeAverage},
+	{Name: "ThreadpoolSearchQueue", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolSearchRejected", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolSearchThreads", Type: metricsTypeAverage},
+	{Name: "ThreadpoolWriteQueue", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolWriteRejected", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolWriteThreads", Type: metricsTypeAverage},
+	{Name: "ThreadpoolBulkQueue", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolBulkRejected", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolBulkThreads", Type: metricsTypeAverage},
+	{Name: "ThreadpoolIndexQueue", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolIndexRejected", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolIndexThreads", Type: metricsTypeAverage},
+	{Name: "ThreadpoolForce_mergeQueue", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolForce_mergeRejected", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolForce_mergeThreads", Type: metricsTypeAverage},
+	{Name: "2xx", Type: metricsTypeSum, Key: "http_2xx"},
+	{Name: "3xx", Type: metricsTypeSum, Key: "http_3xx"},
+	{Name: "4xx", Type: metricsTypeSum, Key: "http_4xx"},
+	{Name: "5xx", Type: metricsTypeSum, Key: "http_5xx"},
+	{Name: "ElasticsearchRequests", Type: metricsTypeSum, Engine: engineElasticsearch},
+	{Name: "OpenSearchRequests", Type: metricsTypeSum, Engine: engineOpenSearch},
+	{Name: "InvalidHostHeaderRequests", Type: metricsTypeSum},
+	{Name: "JVMGCYoungCollectionCount", Type: metricsTypeMaximum},
+	{Name: "JVMGCYoungCollectionTime", Type: metricsTypeMaximum},
+	{Name: "JVMGCOldCollectionCount", Type: metricsTypeMaximum},
+	{Name: "JVMGCOldCollectionTime", Type: metricsTypeMaximum},
+	{Name: "SysMemoryUtilization", Type: metricsTypeMaximum},
+	{Name: "MasterJVMGCYoungCollectionCount", Type: metricsTypeMaximum},
+	{Name: "MasterJVMGCYoungCollectionTime", Type: metricsTypeMaximum},
+	{Name: "MasterJVMGCOldCollectionCount", Type: metricsTypeMaximum},
+	{Name: "MasterJVMGCOldCollectionTime", Type: metricsTypeMaximum},
+	{Name: "MasterSysMemoryUtilization", Type: metricsTypeMaximum},
+	{Name: "WarmCPUUtilization", Type: metricsTypeMaximum},
+	{Name: "WarmJVMMemoryPressure", Type: metricsTypeMaximum},
+	{Name: "WarmFreeStorageSpace", Type: metricsTypeMinimum},
+	{Name: "WarmSearchableDocuments", Type: metricsTypeAverage},
+	{Name: "WarmStorageSpaceUtilization", Type: metricsTypeMaximum},
+	{Name: "WarmSysMemoryUtilization", Type: metricsTypeMaximum},
+	{Name: "HotToWarmMigrationQueueSize", Type: metricsTypeMaximum},
+	{Name: "WarmToHotMigrationQueueSize", Type: metricsTypeMaximum},
+	{Name: "ColdStorageSpaceUtilization", Type: metricsTypeMaximum},
+	{Name: "ColdToWarmMigrationQueueSize", Type: metricsTypeMaximum},
+	{Name: "WarmToColdMigrationQueueSize", Type: metricsTypeMaximum},
+	{Name: "ColdToWarmMigrationLatency", Type: metricsTypeAverage},
+	{Name: "WarmToColdMigrationLatency", Type: metricsTypeAverage},
+	{Name: "Shards.active", Type: metricsTypeMaximum},
+	// The key must not start with Shards.active, see statisticSeries.
+	{Name: "Shards.activePrimary", Type: metricsTypeMaximum, Key: "Shards.primary"},
+	{Name: "Shards.unassigned", Type: metricsTypeMaximum},
+	{Name: "Shards.delayedUnassigned", Type: metricsTypeMaximum},
+	{Name: "Shards.initializing", Type: metricsTypeMaximum},
+	{Name: "Shards.relocating", Type: metricsTypeMaximum},
+	{Name: "OpenSearchDashboardsConcurrentConnections", Type: metricsTypeMaximum, Engine: engineOpenSearch},
+	{Name: "OpenSearchDashboardsClusterConcurrentConnections", Type: metricsTypeMaximum, Engine: engineOpenSearch},
+	{Name: "IndexingLatency", Type: metricsTypeAverage},
+	{Name: "IndexingRate", Type: metricsTypeAverage},
+	{Name: "SearchLatency", Type: metricsTypeAverage},
+	{Name: "SearchRate", Type: metricsTypeAverage},
+	{Name: "KMSKeyError", Type: metricsTypeMaximum},
+	{Name: "KMSKeyInaccessible", Type: metricsTypeMaximum},
+	{Name: "SegmentCount", Type: metricsTypeAverage},
+	{Name: "StorageUtilization", Type: metricsTypeMaximum},
+	{Name: "HotStorageSpaceUtilization", Type: metricsTypeMaximum},
+	{Name: "CoordinatingWriteRejected", Type: metricsTypeSum, Engine: engineOpenSearch},
+	{Name: "PrimaryWriteRejected", Type: metricsTypeSum, Engine: engineOpenSearch},
+	{Name: "ReplicaWriteRejected", Type: metricsTypeSum, Engine: engineOpenSearch},
+	{Name: "AsynchronousSearchSubmissionRate", Type: metricsTypeSum},
+	{Name: "AsynchronousSearchInitializedRate", Type: metricsTypeSum},
+	{Name: "AsynchronousSearchRejected", Type: metricsTypeSum},
+	{Name: "ThreadpoolSqlWorkerQueue", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolSqlWorkerRejected", Type: metricsTypeMaximum},
+	{Name: "AlertingDegraded", Type: metricsTypeMaximum},
+	{Name: "ADPluginUnhealthy", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolGetQueue", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolGetRejected", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolGetThreads", Type: metricsTypeAverage},
+	{Name: "BurstBalance", Type: metricsTypeMinimum},
+	{Name: "ThreadpoolSnapshotQueue", Type: metricsTypeMaximum},
+	{Name: "ThreadpoolSnapshotRejected", Type: metricsTypeMaximum},
+}
+
+// sensibleStatistics lists the statistics that make sense for each graph unit,
+// e.g. summing a percentage across nodes is meaningless. Integer graphs draw
+// gauges like Nodes as well as counters, which have counterStatistics.
+var sensibleStatistics = map[string][]string{
+	"percentage":   {metricsTypeAverage, metricsTypeMaximum},
+	"float":        {metricsTypeAverage, metricsTypeMaximum},
+	"bytes":        {metricsTypeMinimum, metricsTypeMaximum},
+	"bytes/sec":    {metricsTypeAverage, metricsTypeMaximum},
+	"seconds":      {metricsTypeAverage, metricsTypeMaximum},
+	"milliseconds": {metricsTypeAverage, metricsTypeMaximum},
+	"iops":         {metricsTypeAverage, metricsTypeMaximum},
+	"integer":      {metricsTypeAverage, metricsTypeMinimum, metricsTypeMaximum},
+}
+
+// counterStatistics make sense for counters like http_5xx, the integer
+// metrics whose built-in statistic is Sum.
+var counterStatistics = []string{metricsTypeSum}
+
+// sensibleStatisticsOf returns the statistics that make sense for met graphed
+// in unit, and false when any may.
+func sensibleStatisticsOf(met metrics, unit string) ([]string, bool) {
+	if unit == "integer" && met.Type == metricsTypeSum {
+		return counterStatistics, true
+	}
+	allowed, ok := sensibleStatistics[unit]
+	return allowed, ok
 }
 
 // ESPlugin mackerel plugin for aws elasticsearch
@@ -31,19 +208,83 @@ type ESPlugin struct {
 	Region          string
 	AccessKeyID     string
 	SecretAccessKey string
-	Domain          string
-	ClientID        string
-	CloudWatch      *cloudwatch.CloudWatch
-	KeyPrefix       string
-	LabelPrefix     string
+	SessionToken    string
+	Profile         string
+	RoleARN         string
+	ExternalID      string
+	Endpoint        string
+	// Partition is the ID of the AWS partition the endpoints are resolved in,
+	// e.g. aws-us-gov, for regions the SDK does not know. By default it is
+	// told by the region.
+	Partition      string
+	Domain         string
+	ClientID       string
+	CloudWatch     cloudwatchiface.CloudWatchAPI
+	OpenSearch     opensearchserviceiface.OpenSearchServiceAPI
+	KeyPrefix      string
+	LabelPrefix    string
+	StatOverrides  map[string]string
+	IncludeMetrics []string
+	ExcludeMetrics []string
+	DetailedStats  []string
+	Percentiles    []string
+	TopN           int
+	HealthWeights  map[string]float64
+	AnomalyBands   bool
+	SnapshotAge    bool
+	DimensionSet   string
+	// CollectionName is added to the dimensions of the collection metrics of
+	// -serverless when CloudWatch lists them under one.
+	CollectionName string
+	Period         int64
+	Lookback       int64
+	Concurrency    int
+	Timeout        time.Duration
+	MaxRetries     int
+	Engine         string
+	Verbose        bool
+	Serverless     bool
+	AdaptiveWindow bool
+	// InsecureSkipVerify disables TLS certificate verification of the AWS
+	// APIs, for proxies intercepting TLS. It is unsafe.
+	InsecureSkipVerify bool
+	// Proxy is the URL of the proxy AWS requests are made through. When it is
+	// nil, HTTPS_PROXY and the other proxy environment variables are used.
+	Proxy *url.URL
+	// WithSampleCount also fetches the SampleCount of every metric.
+	WithSampleCount bool
+	VolumeSize      int64
+	ExpectedNodes   int64
+	// Namespace replaces AWS/ES (or AWS/AOSS), e.g. for metrics republished
+	// into a custom namespace by a metric stream.
+	Namespace string
+	// DiscoverThreadpools fetches every threadpool metric ListMetrics finds.
+	DiscoverThreadpools bool
+	// Discover fetches the metrics ListMetrics finds instead of all built-in
+	// ones, adding those the plugin does not know.
+	Discover bool
+	// DiscoveryInterval is how long the metrics ListMetrics found are cached
+	// in the state file.
+	DiscoveryInterval time.Duration
+	// ExtraDimensions are added to the DomainName and ClientId dimensions.
+	ExtraDimensions []*cloudwatch.Dimension
+
+	stsClient      *sts.STS
+	metricDefs     *metricDefinitionFile
+	describeDenied bool
+	// metricNames are the cached ListMetrics results, listed every run when nil.
+	metricNames []string
 }
 
+// domainPlaceholder in -metric-key-prefix is replaced with the domain name.
+const domainPlaceholder = "{domain}"
+
 // MetricKeyPrefix interface for PluginWithPrefix
 func (p ESPlugin) MetricKeyPrefix() string {
 	if p.KeyPrefix == "" {
 		return "es"
 	}
-	return p.KeyPrefix
+	return strings.ReplaceAll(p.KeyPrefix, domainPlaceholder, sanitizeKey(p.Domain))
 }
 
 // MetricLabelPrefix ...
@@ -54,136 +295,690 @@ func (p ESPlugin) MetricLabelPrefix() string {
 	return p.LabelPrefix
 }
 
+// metricList returns the metrics to fetch: the built-in ones and those from
+// -metrics-from-file, restricted to -include-metrics when given and without
+// those of -exclude-metrics.
+func (p ESPlugin) metricList() []metrics {
+	var list []metrics
+	if p.metricDefs == nil || !p.metricDefs.Replace {
+		for _, met := range p.builtinMetrics() {
+			if met.Engine == "" || p.Engine == "" || met.Engine == p.Engine {
+				list = append(list, met)
+			}
+		}
+	}
+	if p.metricDefs != nil {
+		for _, def := range p.metricDefs.Metrics {
+			list = append(list, metrics{Name: def.Name, Type: def.Statistic, Period: def.Period})
+		}
+	}
+	return slices.DeleteFunc(list, func(met metrics) bool {
+		return !p.selected(met.Name)
+	})
+}
+
+// selected reports whether -include-metrics and -exclude-metrics let the
+// metric be fetched.
+func (p ESPlugin) selected(name string) bool {
+	if len(p.IncludeMetrics) > 0 && !slices.Contains(p.IncludeMetrics, name) {
+		return false
+	}
+	return !slices.Contains(p.ExcludeMetrics, name)
+}
+
+// checkMetricNames returns an error for the first name that is neither a
+// built-in metric of any engine nor defined by -metrics-from-file.
+func (p ESPlugin) checkMetricNames(names []string) error {
+	known := make(map[string]bool)
+	for _, met := range p.builtinMetrics() {
+		known[met.Name] = true
+	}
+	if p.metricDefs != nil {
+		for _, def := range p.metricDefs.Metrics {
+			known[def.Name] = true
+		}
+	}
+	for _, name := range names {
+		if !known[name] {
+			return fmt.Errorf("unknown metric %q", name)
+		}
+	}
+	return nil
+}
+
+// builtinMetrics returns the metrics of domains or, with -serverless, of
+// serverless collections.
+func (p ESPlugin) builtinMetrics() []metrics {
+	if p.Serverless {
+		return serverlessMetrics
+	}
+	return defaultMetrics
+}
+
+// parseMetricNames splits a comma separated list of metric names.
+func parseMetricNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (p *ESPlugin) newSession() (*session.Session, error) {
+	if p.Profile == "" {
+		return session.NewSession()
+	}
+	return session.NewSessionWithOptions(session.Options{
+		Profile:           p.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+}
+
+// partitionResolver returns the resolver of the endpoints in the partition
+// with the given ID.
+func partitionResolver(id string) (endpoints.Resolver, error) {
+	var ids []string
+	for _, part := range endpoints.DefaultPartitions() {
+		if part.ID() == id {
+			return part, nil
+		}
+		ids = append(ids, part.ID())
+	}
+	return nil, fmt.Errorf("unknown partition %q: expected one of %s", id, strings.Join(ids, ", "))
+}
+
+// httpClient returns the client all AWS requests are made with.
+func (p ESPlugin) httpClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if p.Proxy != nil {
+		transport.Proxy = http.ProxyURL(p.Proxy)
+	}
+	if p.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &http.Client{Timeout: p.Timeout, Transport: transport}
+}
+
+// prepare creates the AWS clients.
 func (p *ESPlugin) prepare() error {
-	sess, err := session.NewSession()
+	sess, err := p.newSession()
 	if err != nil {
 		return err
 	}
 
-	config := aws.NewConfig()
+	config := aws.NewConfig().
+		WithHTTPClient(p.httpClient()).
+		WithMaxRetries(p.MaxRetries)
 	if p.AccessKeyID != "" && p.SecretAccessKey != "" {
-		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, ""))
+		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, p.SessionToken))
 	}
 	if p.Region != "" {
 		config = config.WithRegion(p.Region)
 	}
+	if p.Partition != "" {
+		// Regions the SDK knows resolve in their partition without it.
+		resolver, err := partitionResolver(p.Partition)
+		if err != nil {
+			return err
+		}
+		config = config.WithEndpointResolver(resolver)
+	}
+	if p.RoleARN != "" {
+		// The role is assumed with the credentials configured so far.
+		base := sess.Copy(config)
+		config = config.WithCredentials(stscreds.NewCredentials(base, p.RoleARN, func(o *stscreds.AssumeRoleProvider) {
+			if p.ExternalID != "" {
+				o.ExternalID = aws.String(p.ExternalID)
+			}
+		}))
+	}
 
-	p.CloudWatch = cloudwatch.New(sess, config)
+	cwConfig := config
+	if p.Endpoint != "" {
+		cwConfig = config.Copy().WithEndpoint(p.Endpoint)
+	}
+
+	p.CloudWatch = cloudwatch.New(sess, cwConfig)
+	p.OpenSearch = opensearchservice.New(sess, config)
+	p.stsClient = sts.New(sess, config)
 	return nil
 }
 
-func (p ESPlugin) getLastPointFromCloudWatch(metric metrics) (*cloudwatch.Datapoint, error) {
-	now := time.Now()
+// detectClientID sets the client ID when it is not given, reusing the one in
+// lookups.
+func (p *ESPlugin) detectClientID(lookups *lookupCache) error {
+	if p.ClientID == "" {
+		p.ClientID = lookups.ClientID
+	}
+	if p.ClientID == "" {
+		// The ClientId dimension is the account the domain lives in, which is
+		// usually the account of the credentials.
+		out, err := p.stsClient.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		if err != nil {
+			return fmt.Errorf("failed to detect the client ID, specify -client-id: %w", err)
+		}
+		p.ClientID = aws.StringValue(out.Account)
+		lookups.ClientID = p.ClientID
+	}
+	return nil
+}
 
-	dimensions := []*cloudwatch.Dimension{
-		{
-			Name:  aws.String("DomainName"),
-			Value: aws.String(p.Domain),
-		},
-		{
-			Name:  aws.String("ClientId"),
-			Value: aws.String(p.ClientID),
+// runContext returns the context a run is bounded by, cancelled after Timeout.
+func (p ESPlugin) runContext() (context.Context, context.CancelFunc) {
+	if p.Timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), p.Timeout)
+}
+
+// datapoint is the latest value CloudWatch returned for a query.
+type datapoint struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// metricQuery is a metric to fetch under the given dimensions.
+type metricQuery struct {
+	metric     metrics
+	dimensions []*cloudwatch.Dimension
+}
+
+// period is the period met is fetched with.
+func (p ESPlugin) period(met metrics) int64 {
+	switch {
+	case met.Window > 0:
+		return met.Window
+	case met.Period > 0:
+		return met.Period
+	}
+	return p.Period
+}
+
+// lookback is how far back the datapoints of met are looked for. A metric
+// with its own Period is looked for as many periods back as the others.
+func (p ESPlugin) lookback(met metrics) int64 {
+	switch {
+	case met.Window > 0:
+		return met.Window
+	case met.Period > 0 && p.Period > 0:
+		return max(p.Lookback, p.Lookback*met.Period/p.Period)
+	}
+	return p.Lookback
+}
+
+func (p ESPlugin) metricDataQuery(id string, q metricQuery) *cloudwatch.MetricDataQuery {
+	return &cloudwatch.MetricDataQuery{
+		Id: aws.String(id),
+		MetricStat: &cloudwatch.MetricStat{
+			Metric: &cloudwatch.Metric{
+				Namespace:  aws.String(p.nameSpace()),
+				MetricName: aws.String(q.metric.Name),
+				Dimensions: q.dimensions,
+			},
+			Period: aws.Int64(p.period(q.metric)),
+			Stat:   aws.String(q.metric.Type),
 		},
 	}
+}
 
-	response, err := p.CloudWatch.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
-		Dimensions: dimensions,
-		StartTime:  aws.Time(now.Add(time.Duration(180) * time.Second * -1)),
-		EndTime:    aws.Time(now),
-		MetricName: aws.String(metric.Name),
-		Period:     aws.Int64(60),
-		Statistics: []*string{aws.String(metric.Type)},
-		Namespace:  aws.String(nameSpace),
-	})
+// getLastPointsFromCloudWatch fetches the latest datapoint of every query with
+// GetMetricData, maxMetricDataQueries queries per call. The result is indexed
+// like queries and is nil where there was no datapoint. A failed call does not
+// stop the others; their errors are joined.
+func (p ESPlugin) getLastPointsFromCloudWatch(ctx context.Context, queries []metricQuery) ([]*datapoint, error) {
+	points := make([]*datapoint, len(queries))
+	now := time.Now()
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs []error
+	)
+	sem := make(chan struct{}, max(p.Concurrency, 1))
+	for _, batch := range p.metricDataBatches(queries) {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(batch []int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// Each batch only writes its own points.
+			if err := p.getMetricDataBatchThrottled(ctx, queries, points, batch, now); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(batch)
+	}
+	wg.Wait()
+
+	return points, errors.Join(errs...)
+}
+
+// metricDataBatches splits the indexes of queries into the GetMetricData
+// calls fetching them. A call has a single time range, so metrics looked back
+// for differently are fetched separately.
+func (p ESPlugin) metricDataBatches(queries []metricQuery) [][]int {
+	var (
+		lookbacks  []int64
+		byLookback = make(map[int64][]int)
+	)
+	for i, q := range queries {
+		l := p.lookback(q.metric)
+		if _, ok := byLookback[l]; !ok {
+			lookbacks = append(lookbacks, l)
+		}
+		byLookback[l] = append(byLookback[l], i)
+	}
+	var batches [][]int
+	for _, l := range lookbacks {
+		for batch := range slices.Chunk(byLookback[l], maxMetricDataQueries) {
+			batches = append(batches, batch)
+		}
+	}
+	return batches
+}
+
+// throttleBackoff is the longest first wait before a throttled batch is
+// fetched again. It doubles with every further throttling, up to
+// maxThrottleBackoff. Tests shorten both.
+var (
+	throttleBackoff    = time.Second
+	maxThrottleBackoff = 16 * time.Second
+)
+
+func isThrottled(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && request.IsErrorThrottle(aerr)
+}
 
+// getMetricDataBatchThrottled fetches the batch again while CloudWatch
+// throttles it after the retries of the SDK, with exponential backoff and
+// full jitter, until the run context is done.
+func (p ESPlugin) getMetricDataBatchThrottled(ctx context.Context, queries []metricQuery, points []*datapoint, batch []int, now time.Time) error {
+	backoff := throttleBackoff
+	for {
+		err := p.getMetricDataBatch(ctx, queries, points, batch, now)
+		if err == nil || !isThrottled(err) {
+			return err
+		}
+		wait := rand.N(backoff)
+		p.debugf("throttled, fetching %d queries again in %s", len(batch), wait)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, maxThrottleBackoff)
+	}
+}
+
+func (p ESPlugin) getMetricDataBatch(ctx context.Context, queries []metricQuery, points []*datapoint, batch []int, now time.Time) error {
+	// The queries of a batch share their lookback.
+	lookback := p.lookback(queries[batch[0]].metric)
+	input := &cloudwatch.GetMetricDataInput{
+		StartTime: aws.Time(now.Add(time.Duration(lookback) * time.Second * -1)),
+		EndTime:   aws.Time(now),
+		ScanBy:    aws.String(cloudwatch.ScanByTimestampDescending),
+	}
+	index := make(map[string]int, len(batch))
+	for _, i := range batch {
+		id := fmt.Sprintf("m%d", i)
+		index[id] = i
+		input.MetricDataQueries = append(input.MetricDataQueries, p.metricDataQuery(id, queries[i]))
+	}
+
+	var errs []error
+	err := p.CloudWatch.GetMetricDataPagesWithContext(ctx, input, func(page *cloudwatch.GetMetricDataOutput, lastPage bool) bool {
+		for _, r := range page.MetricDataResults {
+			i, ok := index[aws.StringValue(r.Id)]
+			if !ok {
+				continue
+			}
+			if aws.StringValue(r.StatusCode) == cloudwatch.StatusCodeInternalError {
+				errs = append(errs, fmt.Errorf("%s: internal error", queries[i].metric.Name))
+				continue
+			}
+			points[i] = latestDatapoint(points[i], r)
+		}
+		return true
+	})
 	if err != nil {
-		return nil, err
+		errs = append(errs, err)
 	}
+	return errors.Join(errs...)
+}
 
-	datapoints := response.Datapoints
-	if len(datapoints) == 0 {
-		return nil, nil
+// adaptiveLookback is the window -adaptive-window looks back in for metrics
+// without a datapoint in -lookback, e.g. ones published every 5 minutes.
+const adaptiveLookback = 900
+
+// refetchMissing fetches the queries without a datapoint once more with
+// adaptiveLookback and fills in what it finds.
+func (p ESPlugin) refetchMissing(ctx context.Context, queries []metricQuery, points []*datapoint) error {
+	if p.Lookback >= adaptiveLookback {
+		return nil
+	}
+	var (
+		missing []metricQuery
+		index   []int
+	)
+	for i, dp := range points {
+		if dp == nil {
+			missing = append(missing, queries[i])
+			index = append(index, i)
+		}
 	}
+	if len(missing) == 0 {
+		return nil
+	}
+	wide := p
+	wide.Lookback = adaptiveLookback
+	found, err := wide.getLastPointsFromCloudWatch(ctx, missing)
+	for j, dp := range found {
+		if dp != nil {
+			p.debugf("%s: found a datapoint in the last %ds", missing[j].metric.key(), adaptiveLookback)
+			points[index[j]] = dp
+		}
+	}
+	return err
+}
 
-	latest := new(time.Time)
-	var latestDp *cloudwatch.Datapoint
-	for _, dp := range datapoints {
-		if dp.Timestamp.Before(*latest) {
+// latestDatapoint returns the datapoint of r with the newest timestamp, or
+// latest when that is newer or r has none. Results of a query can span pages,
+// so latest is the pick from the pages before.
+func latestDatapoint(latest *datapoint, r *cloudwatch.MetricDataResult) *datapoint {
+	for j, ts := range r.Timestamps {
+		if j >= len(r.Values) {
+			break
+		}
+		if ts == nil || r.Values[j] == nil {
 			continue
 		}
-
-		latest = dp.Timestamp
-		latestDp = dp
+		if latest == nil || ts.After(latest.Timestamp) {
+			latest = &datapoint{Timestamp: *ts, Value: *r.Values[j]}
+		}
 	}
+	return latest
+}
 
-	return latestDp, nil
+func valueFromDatapoint(dp *datapoint, metric metrics) float64 {
+	value := dp.Value
+	if metric.Name == "ClusterUsedSpace" || metric.Name == "MasterFreeStorageSpace" || metric.Name == "FreeStorageSpace" || metric.Name == "WarmFreeStorageSpace" {
+		// MBytes -> Bytes
+		value = value * 1024 * 1024
+	}
+	return value
 }
 
-func mergeStatFromDatapoint(stat map[string]float64, dp *cloudwatch.Datapoint, metric metrics) map[string]float64 {
+func mergeStatFromDatapoint(stat map[string]float64, dp *datapoint, metric metrics) map[string]float64 {
 	if dp != nil {
-		var value float64
-		if metric.Type == metricsTypeAverage {
-			value = *dp.Average
-		} else if metric.Type == metricsTypeSum {
-			value = *dp.Sum
-		} else if metric.Type == metricsTypeMaximum {
-			value = *dp.Maximum
-		} else if metric.Type == metricsTypeMinimum {
-			value = *dp.Minimum
-		}
-		if metric.Name == "ClusterUsedSpace" || metric.Name == "MasterFreeStorageSpace" || metric.Name == "FreeStorageSpace" {
-			// MBytes -> Bytes
-			value = value * 1024 * 1024
-		}
-		stat[metric.Name] = value
+		stat[metric.key()] = valueFromDatapoint(dp, metric)
 	}
 	return stat
 }
 
+func isValidStatistic(stat string) bool {
+	switch stat {
+	case metricsTypeAverage, metricsTypeSum, metricsTypeMaximum, metricsTypeMinimum:
+		return true
+	}
+	return false
+}
+
+func parseStatOverrides(s string) (map[string]string, error) {
+	overrides := make(map[string]string)
+	if s == "" {
+		return overrides, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		name, stat, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid stat override %q: expected MetricName=Statistic", pair)
+		}
+		if !isValidStatistic(stat) {
+			return nil, fmt.Errorf("invalid statistic %q for %s", stat, name)
+		}
+		overrides[name] = stat
+	}
+	return overrides, nil
+}
+
+// checkStatOverrides warns about overrides whose statistic is neither the
+// built-in one nor sensible for the unit of the graph the metric belongs to.
+func (p ESPlugin) checkStatOverrides() {
+	units := make(map[string]string)
+	for _, graph := range p.GraphDefinition() {
+		for _, m := range graph.Metrics {
+			units[m.Name] = graph.Unit
+		}
+	}
+	for _, met := range p.metricList() {
+		stat, ok := p.StatOverrides[met.Name]
+		if !ok || stat == met.Type {
+			continue
+		}
+		unit := units[met.key()]
+		allowed, ok := sensibleStatisticsOf(met, unit)
+		if !ok || slices.Contains(allowed, stat) {
+			continue
+		}
+		warnf("%s is graphed as %s, for which %s is usually meaningless (expected %s or the default %s)",
+			met.Name, unit, stat, strings.Join(allowed, "/"), met.Type)
+	}
+}
+
 // FetchMetrics interface for mackerelplugin
 func (p ESPlugin) FetchMetrics() (map[string]float64, error) {
+	ctx, cancel := p.runContext()
+	defer cancel()
+	return p.fetchStat(ctx), nil
+}
+
+// fetchStat fetches the metrics within ctx for FetchMetrics. mackerel-plugin
+// would exit with an error and post nothing, so it is only logged and
+// Health=0 is posted.
+func (p ESPlugin) fetchStat(ctx context.Context) map[string]float64 {
+	stat, _, err := p.fetchMetrics(ctx)
+	if err != nil {
+		errorf("%s: %s", p.Domain, err)
+	}
+	return stat
+}
+
+// fetchedMetric is what the value of a metric fetched from CloudWatch is based on.
+type fetchedMetric struct {
+	Statistic string
+	Timestamp time.Time
+}
+
+// fetchMetrics fetches the metrics for FetchMetrics, along with the statistic
+// and timestamp of those fetched from CloudWatch, keyed like the metrics.
+// When nothing could be fetched, it returns the error along with Health=0.
+func (p ESPlugin) fetchMetrics(ctx context.Context) (map[string]float64, map[string]fetchedMetric, error) {
 	stat := make(map[string]float64)
+	fetched := make(map[string]fetchedMetric)
 
-	for _, met := range [...]metrics{
-		{Name: "ClusterStatus.green", Type: metricsTypeMinimum},
-		{Name: "ClusterStatus.yellow", Type: metricsTypeMaximum},
-		{Name: "ClusterStatus.red", Type: metricsTypeMaximum},
-		{Name: "Nodes", Type: metricsTypeAverage},
-		{Name: "SearchableDocuments", Type: metricsTypeAverage},
-		{Name: "DeletedDocuments", Type: metricsTypeAverage},
-		{Name: "CPUUtilization", Type: metricsTypeMaximum},
-		{Name: "FreeStorageSpace", Type: metricsTypeMinimum},
-		{Name: "ClusterUsedSpace", Type: metricsTypeMinimum},
-		{Name: "ClusterIndexWritesBlocked", Type: metricsTypeMaximum},
-		{Name: "JVMMemoryPressure", Type: metricsTypeMaximum},
-		{Name: "AutomatedSnapshotFailure", Type: metricsTypeMaximum},
-		{Name: "KibanaHealthyNodes", Type: metricsTypeMinimum},
-		{Name: "MasterCPUUtilization", Type: metricsTypeMaximum},
-		{Name: "MasterFreeStorageSpace", Type: metricsTypeSum},
-		{Name: "MasterJVMMemoryPressure", Type: metricsTypeMaximum},
-		{Name: "MasterReachableFromNode", Type: metricsTypeMinimum},
-		{Name: "ReadLatency", Type: metricsTypeAverage},
-		{Name: "WriteLatency", Type: metricsTypeAverage},
-		{Name: "ReadThroughput", Type: metricsTypeAverage},
-		{Name: "WriteThroughput", Type: metricsTypeAverage},
-		{Name: "DiskQueueDepth", Type: metricsTypeAverage},
-		{Name: "ReadIOPS", Type: metricsTypeAverage},
-		{Name: "WriteIOPS", Type: metricsTypeAverage},
-	} {
-		v, err := p.getLastPointFromCloudWatch(met)
-		if err == nil {
-			stat = mergeStatFromDatapoint(stat, v, met)
-		} else {
-			log.Printf("%s: %s", met, err)
+	mets := p.metricList()
+	if p.Discover {
+		mets = p.discoverMetrics(ctx, mets)
+	}
+	for i, met := range mets {
+		if t, ok := p.StatOverrides[met.Name]; ok {
+			mets[i].Type = t
+		}
+	}
+	mets = append(mets, p.extraSeries(mets)...)
+	if met, ok := p.nodesMinimumSeries(mets); ok {
+		mets = append(mets, met)
+	}
+	if met, ok := freeStorageSumSeries(mets); ok {
+		mets = append(mets, met)
+	}
+	queries := make([]metricQuery, len(mets))
+	for i, met := range mets {
+		queries[i] = metricQuery{metric: met, dimensions: p.metricDimensions(met)}
+	}
+
+	points, err := p.getLastPointsFromCloudWatch(ctx, queries)
+	if p.AdaptiveWindow && err == nil {
+		err = p.refetchMissing(ctx, queries, points)
+	}
+	for i, met := range mets {
+		stat = mergeStatFromDatapoint(stat, points[i], met)
+	}
+	if err != nil {
+		if len(stat) == 0 {
+			// Nothing could be fetched, e.g. because the credentials are
+			// wrong. Health=0 is posted so that monitoring itself can be
+			// alerted on.
+			return map[string]float64{"Health": 0}, fetched, fmt.Errorf("failed to fetch metrics: %w", err)
+		}
+		errorf("%s: %s", p.Domain, err)
+	} else if len(stat) == 0 {
+		// CloudWatch returns no datapoints rather than an error for
+		// dimensions nothing is published under.
+		warnf("%s: no datapoint for any metric in the last %ds, the domain name or -client-id may be wrong (dimensions %s)", p.Domain, p.Lookback, p.dimensionString())
+	}
+	for i, met := range mets {
+		if points[i] == nil {
+			p.debugf("%s (%s): no datapoint in the last %ds", met.key(), met.Type, p.lookback(met))
+			continue
+		}
+		fetched[met.key()] = fetchedMetric{Statistic: met.Type, Timestamp: points[i].Timestamp}
+		p.debugf("%s (%s): %g at %s", met.key(), met.Type, valueFromDatapoint(points[i], met), points[i].Timestamp.Format(time.RFC3339))
+	}
+
+	if p.TopN > 0 {
+		p.fetchTopNodes(ctx, stat)
+	}
+	if p.DiscoverThreadpools {
+		p.fetchDiscoveredThreadpools(ctx, stat)
+	}
+
+	if p.SnapshotAge {
+		if err := p.fetchSnapshotAge(ctx, stat); err != nil {
+			errorf("%s: snapshot age: %s", p.Domain, err)
+		}
+	}
+
+	if p.AnomalyBands {
+		if err := p.fetchAnomalyBands(ctx, stat); err != nil {
+			errorf("%s: anomaly detection bands: %s", p.Domain, err)
+		}
+	}
+
+	if v, ok := sumOf(stat, "ReadThroughput", "WriteThroughput"); ok {
+		stat["TotalThroughput"] = v
+	}
+	if v, ok := sumOf(stat, "ReadIOPS", "WriteIOPS"); ok {
+		stat["TotalIOPS"] = v
+	}
+	// 5xx is posted as http_5xx, and a key should not start with a digit.
+	// Only domains of one engine publish each of the request counts.
+	for _, requests := range []string{"OpenSearchRequests", "ElasticsearchRequests"} {
+		if _, ok := stat[requests]; !ok {
+			continue
 		}
+		if v, ok := percentOf(stat, "http_5xx", requests); ok {
+			stat["http_5xxErrorRate"] = v
+		}
+		break
+	}
+	if v, ok := freeStorageSpacePercent(stat); ok {
+		stat["FreeStorageSpacePercent"] = v
+	}
+	if v, ok := nodesMissing(stat, p.ExpectedNodes); ok {
+		stat["NodesMissing"] = v
+	}
+	if v, ok := worstNodeFreeStoragePercent(stat, p.VolumeSize); ok {
+		stat["WorstNodeFreeStorageSpacePercent"] = v
 	}
 
-	return stat, nil
+	if score, ok := domainHealthScore(stat, p.HealthWeights); ok {
+		stat["DomainHealthScore"] = score
+	}
+
+	stat["Health"] = boolScore(p.fetchedStatus(stat))
+	return stat, fetched, nil
 }
 
 // GraphDefinition interface for mackerelplugin
 func (p ESPlugin) GraphDefinition() map[string]mp.Graphs {
 	labelPrefix := p.MetricLabelPrefix()
+	graphs := make(map[string]mp.Graphs)
+	if p.metricDefs == nil || !p.metricDefs.Replace {
+		if p.Serverless {
+			graphs = serverlessGraphDefinition(labelPrefix)
+		} else {
+			graphs = defaultGraphDefinition(labelPrefix)
+		}
+	}
+	graphs["Health"] = mp.Graphs{
+		Label: labelPrefix + " Monitoring Health",
+		Unit:  "integer",
+		Metrics: []mp.Metrics{
+			{Name: "Health", Label: "Health"},
+		},
+	}
+	if p.TopN > 0 {
+		maps.Copy(graphs, topNodeGraphDefinitions(labelPrefix))
+	}
+	if p.SnapshotAge {
+		graphs["SnapshotAge"] = mp.Graphs{
+			Label: (labelPrefix + " SnapshotAge"),
+			Unit:  "seconds",
+			Metrics: []mp.Metrics{
+				{Name: "SnapshotAgeSeconds", Label: "SnapshotAgeSeconds"},
+			},
+		}
+	}
+	if p.DiscoverThreadpools {
+		graphs["Threadpool.#"] = threadpoolGraphDefinition(labelPrefix)
+	}
+	if p.Discover {
+		graphs["Discovered.#"] = discoveredGraphDefinition(labelPrefix)
+	}
+	if p.AnomalyBands {
+		for _, name := range anomalyBandMetrics {
+			g, ok := graphs[name]
+			if !ok {
+				continue
+			}
+			g.Metrics = append(g.Metrics,
+				mp.Metrics{Name: "expectedUpper." + name, Label: "Expected upper"},
+				mp.Metrics{Name: "expectedLower." + name, Label: "Expected lower"},
+			)
+			graphs[name] = g
+		}
+	}
+	if p.metricDefs != nil {
+		for _, def := range p.metricDefs.Metrics {
+			key := normalizeKey(def.Graph)
+			g, ok := graphs[key]
+			if !ok {
+				g = mp.Graphs{
+					Label: labelPrefix + " " + def.Graph,
+					Unit:  def.Unit,
+				}
+			}
+			label := def.Label
+			if label == "" {
+				label = def.Name
+			}
+			g.Metrics = append(g.Metrics, mp.Metrics{Name: normalizeKey(def.Name), Label: label, Scale: def.Scale})
+			graphs[key] = g
+		}
+	}
+	p.addExtraSeries(graphs)
+	if p.WithSampleCount {
+		graphs["SampleCounts"] = p.sampleCountGraphDefinition(labelPrefix)
+	}
+	return graphs
+}
+
+func defaultGraphDefinition(labelPrefix string) map[string]mp.Graphs {
 	return map[string]mp.Graphs{
 		"ClusterStatus": {
 			Label: (labelPrefix + " ClusterStatus"),
@@ -201,6 +996,14 @@ func (p ESPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "Nodes", Label: "Nodes"},
 			},
 		},
+		// Drawn apart from Nodes, whose key it starts with.
+		"NodesMissing": {
+			Label: (labelPrefix + " NodesMissing"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "NodesMissing", Label: "NodesMissing"},
+			},
+		},
 		"SearchableDocuments": {
 			Label: (labelPrefix + " SearchableDocuments"),
 			Unit:  "integer",
@@ -264,6 +1067,13 @@ func (p ESPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "KibanaHealthyNodes", Label: "KibanaHealthyNodes"},
 			},
 		},
+		"OpenSearchDashboardsHealthyNodes": {
+			Label: (labelPrefix + " OpenSearchDashboardsHealthyNodes"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "OpenSearchDashboardsHealthyNodes", Label: "OpenSearchDashboardsHealthyNodes"},
+			},
+		},
 		"MasterCPUUtilization": {
 			Label: (labelPrefix + " MasterCPUUtilization"),
 			Unit:  "percentage",
@@ -287,14 +1097,14 @@ func (p ESPlugin) GraphDefinition() map[string]mp.Graphs {
 		},
 		"MasterReachableFromNode": {
 			Label: (labelPrefix + " MasterReachableFromNode"),
-			Unit:  "percentage",
+			Unit:  "integer",
 			Metrics: []mp.Metrics{
 				{Name: "MasterReachableFromNode", Label: "MasterReachableFromNode"},
 			},
 		},
 		"Latency": {
 			Label: (labelPrefix + " Latency"),
-			Unit:  "float",
+			Unit:  "seconds",
 			Metrics: []mp.Metrics{
 				{Name: "ReadLatency", Label: "ReadLatency"},
 				{Name: "WriteLatency", Label: "WriteLatency"},
@@ -306,11 +1116,12 @@ func (p ESPlugin) GraphDefinition() map[string]mp.Graphs {
 			Metrics: []mp.Metrics{
 				{Name: "ReadThroughput", Label: "ReadThroughput"},
 				{Name: "WriteThroughput", Label: "WriteThroughput"},
+				{Name: "TotalThroughput", Label: "TotalThroughput"},
 			},
 		},
 		"DiskQueueDepth": {
 			Label: (labelPrefix + " DiskQueueDepth"),
-			Unit:  "integer",
+			Unit:  "float",
 			Metrics: []mp.Metrics{
 				{Name: "DiskQueueDepth", Label: "DiskQueueDepth"},
 			},
@@ -321,8 +1132,414 @@ func (p ESPlugin) GraphDefinition() map[string]mp.Graphs {
 			Metrics: []mp.Metrics{
 				{Name: "ReadIOPS", Label: "ReadIOPS"},
 				{Name: "WriteIOPS", Label: "WriteIOPS"},
+				{Name: "TotalIOPS", Label: "TotalIOPS"},
+			},
+		},
+		"ThreadpoolSearch": {
+			Label: (labelPrefix + " ThreadpoolSearch"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ThreadpoolSearchQueue", Label: "Queue"},
+				{Name: "ThreadpoolSearchRejected", Label: "Rejected"},
+				{Name: "ThreadpoolSearchThreads", Label: "Threads"},
+			},
+		},
+		"DomainHealth": {
+			Label: (labelPrefix + " Domain Health"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "DomainHealthScore", Label: "Score"},
+			},
+		},
+		"ThreadpoolWrite": {
+			Label: (labelPrefix + " ThreadpoolWrite"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ThreadpoolWriteQueue", Label: "Queue"},
+				{Name: "ThreadpoolWriteRejected", Label: "Rejected"},
+				{Name: "ThreadpoolWriteThreads", Label: "Threads"},
+			},
+		},
+		"ThreadpoolBulk": {
+			Label: (labelPrefix + " ThreadpoolBulk"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ThreadpoolBulkQueue", Label: "Queue"},
+				{Name: "ThreadpoolBulkRejected", Label: "Rejected"},
+				{Name: "ThreadpoolBulkThreads", Label: "Threads"},
+			},
+		},
+		"ThreadpoolIndex": {
+			Label: (labelPrefix + " ThreadpoolIndex"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ThreadpoolIndexQueue", Label: "Queue"},
+				{Name: "ThreadpoolIndexRejected", Label: "Rejected"},
+				{Name: "ThreadpoolIndexThreads", Label: "Threads"},
 			},
 		},
+		"ThreadpoolForceMerge": {
+			Label: (labelPrefix + " ThreadpoolForce_merge"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ThreadpoolForce_mergeQueue", Label: "Queue"},
+				{Name: "ThreadpoolForce_mergeRejected", Label: "Rejected"},
+				{Name: "ThreadpoolForce_mergeThreads", Label: "Threads"},
+			},
+		},
+		"HTTPResponseCodes": {
+			Label: (labelPrefix + " HTTP Response Codes"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "http_2xx", Label: "2xx"},
+				{Name: "http_3xx", Label: "3xx"},
+				{Name: "http_4xx", Label: "4xx"},
+				{Name: "http_5xx", Label: "5xx"},
+			},
+		},
+		"Requests": {
+			Label: (labelPrefix + " Requests"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ElasticsearchRequests", Label: "ElasticsearchRequests"},
+				{Name: "OpenSearchRequests", Label: "OpenSearchRequests"},
+				{Name: "InvalidHostHeaderRequests", Label: "InvalidHostHeaderRequests"},
+			},
+		},
+		"JVMGarbageCollection": {
+			Label: (labelPrefix + " JVM Garbage Collection"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "JVMGCYoungCollectionCount", Label: "Young count"},
+				{Name: "JVMGCYoungCollectionTime", Label: "Young time (ms)"},
+				{Name: "JVMGCOldCollectionCount", Label: "Old count"},
+				{Name: "JVMGCOldCollectionTime", Label: "Old time (ms)"},
+			},
+		},
+		"SysMemoryUtilization": {
+			Label: (labelPrefix + " SysMemoryUtilization"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "SysMemoryUtilization", Label: "SysMemoryUtilization"},
+			},
+		},
+		"MasterJVMGarbageCollection": {
+			Label: (labelPrefix + " Master JVM Garbage Collection"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "MasterJVMGCYoungCollectionCount", Label: "Young count"},
+				{Name: "MasterJVMGCYoungCollectionTime", Label: "Young time (ms)"},
+				{Name: "MasterJVMGCOldCollectionCount", Label: "Old count"},
+				{Name: "MasterJVMGCOldCollectionTime", Label: "Old time (ms)"},
+			},
+		},
+		"MasterSysMemory": {
+			Label: (labelPrefix + " MasterSysMemoryUtilization"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "MasterSysMemoryUtilization", Label: "MasterSysMemoryUtilization"},
+			},
+		},
+		"WarmCPUUtilization": {
+			Label: (labelPrefix + " Warm CPU Utilization"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "WarmCPUUtilization", Label: "WarmCPUUtilization"},
+			},
+		},
+		"WarmJVMMemoryPressure": {
+			Label: (labelPrefix + " WarmJVMMemoryPressure"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "WarmJVMMemoryPressure", Label: "WarmJVMMemoryPressure"},
+			},
+		},
+		"WarmStorage": {
+			Label: (labelPrefix + " Warm Free Storage Space"),
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "WarmFreeStorageSpace", Label: "WarmFreeStorageSpace"},
+			},
+		},
+		"WarmStorageSpaceUtilization": {
+			Label: (labelPrefix + " WarmStorageSpaceUtilization"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "WarmStorageSpaceUtilization", Label: "WarmStorageSpaceUtilization"},
+			},
+		},
+		"WarmSearchableDocuments": {
+			Label: (labelPrefix + " WarmSearchableDocuments"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "WarmSearchableDocuments", Label: "WarmSearchableDocuments"},
+			},
+		},
+		"WarmSysMemoryUtilization": {
+			Label: (labelPrefix + " WarmSysMemoryUtilization"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "WarmSysMemoryUtilization", Label: "WarmSysMemoryUtilization"},
+			},
+		},
+		"MigrationQueue": {
+			Label: (labelPrefix + " Migration Queue"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "HotToWarmMigrationQueueSize", Label: "HotToWarm"},
+				{Name: "WarmToHotMigrationQueueSize", Label: "WarmToHot"},
+			},
+		},
+		"ColdStorage": {
+			Label: (labelPrefix + " Cold Storage Space Utilization"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "ColdStorageSpaceUtilization", Label: "ColdStorageSpaceUtilization"},
+			},
+		},
+		"ColdMigrationQueue": {
+			Label: (labelPrefix + " Cold Migration Queue"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ColdToWarmMigrationQueueSize", Label: "ColdToWarm"},
+				{Name: "WarmToColdMigrationQueueSize", Label: "WarmToCold"},
+			},
+		},
+		"ColdMigrationLatency": {
+			Label: (labelPrefix + " Cold Migration Latency"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "ColdToWarmMigrationLatency", Label: "ColdToWarm"},
+				{Name: "WarmToColdMigrationLatency", Label: "WarmToCold"},
+			},
+		},
+		"Shards": {
+			Label: (labelPrefix + " Shards"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "Shards.active", Label: "active", Stacked: true},
+				{Name: "Shards.primary", Label: "activePrimary"},
+				{Name: "Shards.unassigned", Label: "unassigned", Stacked: true},
+				{Name: "Shards.delayedUnassigned", Label: "delayedUnassigned", Stacked: true},
+				{Name: "Shards.initializing", Label: "initializing", Stacked: true},
+				{Name: "Shards.relocating", Label: "relocating", Stacked: true},
+			},
+		},
+		"OpenSearchDashboardsConcurrentConnections": {
+			Label: (labelPrefix + " OpenSearchDashboardsConcurrentConnections"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "OpenSearchDashboardsConcurrentConnections", Label: "OpenSearchDashboardsConcurrentConnections"},
+				{Name: "OpenSearchDashboardsClusterConcurrentConnections", Label: "OpenSearchDashboardsClusterConcurrentConnections"},
+			},
+		},
+		"IndexingPerformance": {
+			Label: (labelPrefix + " Indexing Performance"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "IndexingLatency", Label: "Latency (ms)"},
+				{Name: "IndexingRate", Label: "Rate (per minute)"},
+			},
+		},
+		"SearchPerformance": {
+			Label: (labelPrefix + " Search Performance"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "SearchLatency", Label: "Latency (ms)"},
+				{Name: "SearchRate", Label: "Rate (per minute)"},
+			},
+		},
+		"KMSKeyStatus": {
+			Label: (labelPrefix + " KMS Key Status"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "KMSKeyError", Label: "KMSKeyError"},
+				{Name: "KMSKeyInaccessible", Label: "KMSKeyInaccessible"},
+			},
+		},
+		"SegmentCount": {
+			Label: (labelPrefix + " SegmentCount"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "SegmentCount", Label: "SegmentCount"},
+			},
+		},
+		"StorageUtilization": {
+			Label: (labelPrefix + " StorageUtilization"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "FreeStorageSpacePercent", Label: "FreeStorageSpacePercent"},
+				{Name: "StorageUtilization", Label: "StorageUtilization"},
+				{Name: "WorstNodeFreeStorageSpacePercent", Label: "WorstNodeFreeStorageSpacePercent"},
+			},
+		},
+		"HotStorage": {
+			Label: (labelPrefix + " Hot Storage"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "HotStorageSpaceUtilization", Label: "HotStorageSpaceUtilization"},
+			},
+		},
+		"WriteRejections": {
+			Label: (labelPrefix + " Write Rejections"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "CoordinatingWriteRejected", Label: "Coordinating"},
+				{Name: "PrimaryWriteRejected", Label: "Primary"},
+				{Name: "ReplicaWriteRejected", Label: "Replica"},
+			},
+		},
+		"AsynchronousSearch": {
+			Label: (labelPrefix + " Asynchronous Search"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "AsynchronousSearchSubmissionRate", Label: "Submitted"},
+				{Name: "AsynchronousSearchInitializedRate", Label: "Initialized"},
+				{Name: "AsynchronousSearchRejected", Label: "Rejected"},
+			},
+		},
+		"ThreadpoolSqlWorker": {
+			Label: (labelPrefix + " ThreadpoolSqlWorker"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ThreadpoolSqlWorkerQueue", Label: "Queue"},
+				{Name: "ThreadpoolSqlWorkerRejected", Label: "Rejected"},
+			},
+		},
+		"PluginHealth": {
+			Label: (labelPrefix + " Plugin Health"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "AlertingDegraded", Label: "AlertingDegraded"},
+				{Name: "ADPluginUnhealthy", Label: "ADPluginUnhealthy"},
+			},
+		},
+		"ThreadpoolGet": {
+			Label: (labelPrefix + " ThreadpoolGet"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ThreadpoolGetQueue", Label: "Queue"},
+				{Name: "ThreadpoolGetRejected", Label: "Rejected"},
+				{Name: "ThreadpoolGetThreads", Label: "Threads"},
+			},
+		},
+		"Storage": {
+			Label: (labelPrefix + " Storage"),
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "ClusterUsedSpace", Label: "ClusterUsedSpace", Stacked: true},
+				// The Minimum of FreeStorageSpace is one node's, the Sum the cluster's.
+				{Name: "sum.FreeStorageSpace", Label: "FreeStorageSpace", Stacked: true},
+			},
+		},
+		"VolumeBalance": {
+			Label: (labelPrefix + " Volume Balance"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "BurstBalance", Label: "BurstBalance"},
+			},
+		},
+		"ThreadpoolSnapshot": {
+			Label: (labelPrefix + " ThreadpoolSnapshot"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ThreadpoolSnapshotQueue", Label: "Queue"},
+				{Name: "ThreadpoolSnapshotRejected", Label: "Rejected"},
+			},
+		},
+		"ErrorRate": {
+			Label: (labelPrefix + " Error Rate"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "http_5xxErrorRate", Label: "5xxErrorRate"},
+			},
+		},
+	}
+}
+
+// topNodeGraphDefinitions draws the worst nodes of each metric of -top-n in a
+// graph of its own, with the unit of the metric and a series per node.
+func topNodeGraphDefinitions(labelPrefix string) map[string]mp.Graphs {
+	graphs := make(map[string]mp.Graphs, len(topNodeMetrics))
+	for _, m := range topNodeMetrics {
+		graphs["topnode."+m.Name] = mp.Graphs{
+			Label: (labelPrefix + " Top Nodes " + m.Name),
+			Unit:  m.unit,
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1"},
+			},
+		}
+	}
+	return graphs
+}
+
+// regionFromEC2Metadata asks the instance metadata service for the region.
+// The SDK requests an IMDSv2 session token first, so this works on instances
+// with IMDSv1 disabled; falling back to IMDSv1 is kept for older setups.
+func regionFromEC2Metadata() (string, error) {
+	sess, err := session.NewSession(aws.NewConfig().WithEC2MetadataEnableFallback(true))
+	if err != nil {
+		return "", err
+	}
+	return ec2metadata.New(sess).Region()
+}
+
+// resolveRegion finds the region when -region is omitted like other AWS tools
+// do: from AWS_REGION or AWS_DEFAULT_REGION, the shared config of the
+// profile, and finally EC2 instance metadata, whose answer is kept in lookups.
+func resolveRegion(profile string, lookups *lookupCache) (string, error) {
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(env); region != "" {
+			return region, nil
+		}
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err == nil && aws.StringValue(sess.Config.Region) != "" {
+		return aws.StringValue(sess.Config.Region), nil
+	}
+	if lookups.Region != "" {
+		return lookups.Region, nil
+	}
+	region, err := regionFromEC2Metadata()
+	if err != nil {
+		return "", fmt.Errorf("failed to detect the region, specify -region or AWS_REGION: not in the shared config and EC2 instance metadata failed: %w", err)
+	}
+	lookups.Region = region
+	return region, nil
+}
+
+// resolveState settles the engine and dimension set of the domain, and the
+// metric names discovered for it, using and updating the state cached for it.
+// Graph definitions do not depend on them, so nothing is looked up when only
+// those are requested.
+func (p *ESPlugin) resolveState(ctx context.Context, tempfile string, key string) {
+	if os.Getenv("MACKEREL_AGENT_PLUGIN_META") != "" {
+		if p.Engine == engineAuto {
+			p.Engine = ""
+		}
+		return
+	}
+
+	stateFile := stateFilePath(tempfile, key, p.Domain)
+	st := loadState(stateFile, key)
+	cached := st
+	// Collections have neither an engine nor alternative dimension sets.
+	if p.Serverless {
+		p.resolveCollectionName(ctx, &st)
+	} else {
+		p.resolveEngine(ctx, &st)
+		p.resolveDimensionSet(ctx, &st)
+	}
+	if p.Discover || p.DiscoverThreadpools {
+		p.resolveMetricNames(ctx, &st)
+	}
+	if !st.equal(cached) {
+		if err := saveState(stateFile, st); err != nil {
+			errorf("save state: %s", err)
+		}
 	}
 }
 
@@ -331,42 +1548,254 @@ func Do() {
 	optRegion := flag.String("region", "", "AWS Region")
 	optAccessKeyID := flag.String("access-key-id", "", "AWS Access Key ID")
 	optSecretAccessKey := flag.String("secret-access-key", "", "AWS Secret Access Key")
-	optClientID := flag.String("client-id", "", "AWS Client ID")
-	optDomain := flag.String("domain", "", "ES domain name")
+	optSessionToken := flag.String("session-token", "", "AWS Session Token for temporary credentials")
+	optProfile := flag.String("profile", "", "AWS shared config profile")
+	optRoleARN := flag.String("role-arn", "", "ARN of an IAM role to assume")
+	optExternalID := flag.String("external-id", "", "External ID used to assume -role-arn")
+	optEndpoint := flag.String("endpoint", "", "CloudWatch endpoint URL, e.g. of a VPC interface endpoint")
+	flag.StringVar(optEndpoint, "endpoint-url", "", "Alias of -endpoint")
+	optPartition := flag.String("partition", "", "AWS partition like aws-us-gov or aws-cn to resolve endpoints in, told by the region by default")
+	optClientID := flag.String("client-id", "", "AWS Client ID (account ID of the domain, detected with STS when omitted)")
+	optDomain := flag.String("domain", "", "ES domain name, or comma separated names to poll several domains")
+	var optDimensions dimensionFlag
+	optNamespace := flag.String("namespace", "", "CloudWatch namespace of the metrics, AWS/ES (or AWS/AOSS with -serverless) by default")
+	flag.Var(&optDimensions, "dimension", "Additional CloudWatch dimension as Name=Value, can be repeated")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
-	optKeyPrefix := flag.String("metric-key-prefix", "es", "Metric key prefix")
+	optKeyPrefix := flag.String("metric-key-prefix", "es", "Metric key prefix, {domain} is replaced with the domain name")
 	optLabelPrefix := flag.String("metric-label-prefix", "AWS ES", "Metric label prefix")
+	optStatOverride := flag.String("stat-override", "", "Comma separated MetricName=Statistic pairs overriding the statistic fetched")
+	optIncludeMetrics := flag.String("include-metrics", "", "Comma separated metric names to fetch instead of all of them")
+	optExcludeMetrics := flag.String("exclude-metrics", "", "Comma separated metric names not to fetch")
+	optDetailedStats := flag.String("detailed-stats", "", "Comma separated metric names to also fetch with every statistic as average.<metric>, maximum., minimum. and sum.<metric>")
+	optLatencyPercentiles := flag.String("latency-percentiles", "", "Comma separated percentiles like p90,p99 to also fetch of ReadLatency, WriteLatency, SearchLatency and IndexingLatency")
+	optVolumeSize := flag.Int64("volume-size", 0, "EBS volume size of a data node in GiB, enabling WorstNodeFreeStorageSpacePercent (0 disables)")
+	optServerless := flag.Bool("serverless", false, "Monitor an OpenSearch Serverless collection, whose ID is given with -domain")
+	optExpectedNodes := flag.Int64("expected-nodes", 0, "Number of nodes of the domain, enabling NodesMissing (0 disables)")
+	optDiscover := flag.Bool("discover", false, "Fetch only the metrics the domain publishes, found with ListMetrics, and also unknown ones into the Discovered.# graph")
+	optDiscoveryInterval := flag.Duration("discovery-interval", time.Hour, "How long the metrics found by -discover and -discover-threadpools are cached")
+	optDiscoverThreadpools := flag.Bool("discover-threadpools", false, "Also fetch every threadpool metric the domain publishes, found with ListMetrics, into the Threadpool.# graph")
+	optTopN := flag.Int("top-n", 0, "Also emit the N worst nodes for node level metrics (0 disables)")
+	optHealthWeights := flag.String("health-weights", "", "Comma separated component=weight pairs for DomainHealthScore (status, jvm, storage, writes, snapshot)")
+	optEngine := flag.String("engine", engineAuto, "Engine of the domain selecting its metric set: es, opensearch or auto")
+	optAnomalyBands := flag.Bool("anomaly-bands", false, "Fetch the CloudWatch anomaly detection band of CPUUtilization and JVMMemoryPressure")
+	optSnapshotAge := flag.Bool("snapshot-age", false, "Also post SnapshotAgeSeconds, the approximate age of the last successful automated snapshot, at the cost of a request per run")
+	optWithSampleCount := flag.Bool("with-sample-count", false, "Also post the number of samples of every datapoint as samplecount.<metric>")
+	optAdaptiveWindow := flag.Bool("adaptive-window", false, "Look back 900 seconds for metrics without a datapoint in -lookback")
+	optPeriod := flag.Int64("period", defaultPeriod, "CloudWatch period in seconds")
+	optLookback := flag.Int64("lookback", defaultLookback, "How far back in seconds to look for the latest datapoint")
+	optConcurrency := flag.Int("concurrency", defaultConcurrency, "Number of GetMetricData requests issued in parallel")
+	optTimeout := flag.Duration("timeout", defaultTimeout, "Timeout of each HTTP request to AWS and of the whole metric collection")
+	optMaxRetries := flag.Int("max-retries", defaultMaxRetries, "Maximum number of retries of a failed AWS request")
+	optProxy := flag.String("proxy", "", "URL of the proxy to make AWS requests through, HTTPS_PROXY by default")
+	optInsecureSkipVerify := flag.Bool("insecure-skip-verify", false, "Do not verify the TLS certificates of AWS, e.g. behind a TLS intercepting proxy (unsafe)")
+	optJSON := flag.Bool("json", false, "Print the fetched values with their statistics and timestamps as JSON and exit")
+	optFormat := flag.String("format", formatMackerel, "Output format: mackerel or prometheus")
+	optVerbose := flag.Bool("verbose", false, "Log every metric fetched with its value and timestamp")
+	optListDomains := flag.Bool("list-domains", false, "Print the names of the domains in the region and exit")
+	optCheckPermissions := flag.Bool("check-permissions", false, "Check that the credentials are allowed the IAM actions the flags need and exit")
+	optShowGraphDef := flag.Bool("show-graphdef", false, "Print the graph definitions as JSON and exit without calling AWS")
+	optMetricsFromFile := flag.String("metrics-from-file", "", "JSON file defining metrics to fetch in addition to (or instead of) the built-in ones")
+	optConfig := flag.String("config", "", "JSON file setting flags by name, overridden by the command line")
 	flag.Parse()
 
+	if err := applyEnvironment(flag.CommandLine); err != nil {
+		log.Fatalln(err)
+	}
+	if *optConfig != "" {
+		if err := applyConfigFile(flag.CommandLine, *optConfig); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if !*optListDomains {
+		if strings.TrimSpace(*optDomain) == "" {
+			log.Fatalln("-domain is required: the name of the domain to monitor, or comma separated names")
+		}
+		for _, name := range strings.Split(*optDomain, ",") {
+			if strings.TrimSpace(name) == "" {
+				log.Fatalf("invalid domain %q: empty name in the list", *optDomain)
+			}
+		}
+	}
+
 	var es ESPlugin
 
-	if *optRegion == "" {
-		sess, err := session.NewSession()
+	key := flagsKey(flag.CommandLine)
+	lookupsFile := lookupCachePath(*optTempfile, key)
+	lookups := loadLookupCache(lookupsFile, key)
+
+	if *optRegion == "" && !*optShowGraphDef {
+		region, err := resolveRegion(*optProfile, &lookups)
 		if err != nil {
 			log.Fatalln(err)
 		}
-		ec2metadata := ec2metadata.New(sess)
-		if ec2metadata.Available() {
-			es.Region, _ = ec2metadata.Region()
-		}
+		es.Region = region
 	} else {
 		es.Region = *optRegion
 	}
 
-	es.Region = *optRegion
 	es.Domain = *optDomain
 	es.ClientID = *optClientID
 	es.AccessKeyID = *optAccessKeyID
 	es.SecretAccessKey = *optSecretAccessKey
+	es.SessionToken = *optSessionToken
+	es.Profile = *optProfile
+	es.RoleARN = *optRoleARN
+	es.ExternalID = *optExternalID
+	es.Endpoint = *optEndpoint
+	es.Partition = *optPartition
 	es.KeyPrefix = *optKeyPrefix
 	es.LabelPrefix = *optLabelPrefix
+	es.ExcludeMetrics = parseMetricNames(*optExcludeMetrics)
+	es.TopN = *optTopN
+	es.Engine = *optEngine
+	es.AnomalyBands = *optAnomalyBands
+	es.SnapshotAge = *optSnapshotAge
+	es.Period = *optPeriod
+	es.Lookback = *optLookback
+	es.Concurrency = *optConcurrency
+	es.Timeout = *optTimeout
+	es.MaxRetries = *optMaxRetries
+	es.Verbose = *optVerbose
+	es.Serverless = *optServerless
+	es.AdaptiveWindow = *optAdaptiveWindow
+	es.WithSampleCount = *optWithSampleCount
+	es.InsecureSkipVerify = *optInsecureSkipVerify
+	if *optProxy != "" {
+		u, err := url.Parse(*optProxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			log.Fatalf("invalid -proxy %q: expected a URL like http://proxy:3128", *optProxy)
+		}
+		es.Proxy = u
+	}
+	es.VolumeSize = *optVolumeSize
+	es.ExpectedNodes = *optExpectedNodes
+	es.Namespace = *optNamespace
+	es.DiscoverThreadpools = *optDiscoverThreadpools
+	es.Discover = *optDiscover
+	es.DiscoveryInterval = *optDiscoveryInterval
+	es.ExtraDimensions = optDimensions
+
+	if *optMetricsFromFile != "" {
+		defs, err := loadMetricDefinitions(*optMetricsFromFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		es.metricDefs = defs
+	}
+
+	weights, err := parseHealthWeights(*optHealthWeights)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	es.HealthWeights = weights
+
+	overrides, err := parseStatOverrides(*optStatOverride)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := es.checkMetricNames(slices.Sorted(maps.Keys(overrides))); err != nil {
+		log.Fatalf("invalid stat-override: %s", err)
+	}
+	es.StatOverrides = overrides
+	es.checkStatOverrides()
+
+	es.IncludeMetrics = parseMetricNames(*optIncludeMetrics)
+	if err := es.checkMetricNames(es.IncludeMetrics); err != nil {
+		log.Fatalf("invalid include-metrics: %s", err)
+	}
+	es.DetailedStats = parseMetricNames(*optDetailedStats)
+	if err := es.checkMetricNames(es.DetailedStats); err != nil {
+		log.Fatalf("invalid detailed-stats: %s", err)
+	}
+	percentiles, err := parsePercentiles(*optLatencyPercentiles)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	es.Percentiles = percentiles
+
+	if err := es.validate(); err != nil {
+		log.Fatalln(err)
+	}
+
+	switch *optFormat {
+	case formatMackerel, formatPrometheus:
+	default:
+		log.Fatalf("invalid format %q: expected mackerel or prometheus", *optFormat)
+	}
 
-	err := es.prepare()
+	switch es.Engine {
+	case engineAuto, engineElasticsearch, engineOpenSearch:
+	default:
+		log.Fatalf("invalid engine %q: expected es, opensearch or auto", es.Engine)
+	}
+	if es.Serverless {
+		es.Engine = ""
+	}
+
+	names := strings.Split(*optDomain, ",")
+	if err := checkKeyPrefix(es.KeyPrefix, len(names)); err != nil {
+		log.Fatalln(err)
+	}
+	if *optShowGraphDef {
+		// Graph definitions only depend on the flags, so AWS is not called.
+		if err := printGraphDefinition(os.Stdout, newPlugin(es.forDomains(names))); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	err = es.prepare()
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	helper := mp.NewMackerelPlugin(es)
+	if *optListDomains {
+		names, err := es.listDomains()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return
+	}
+
+	if err := es.detectClientID(&lookups); err != nil {
+		log.Fatalln(err)
+	}
+	if err := saveLookupCache(lookupsFile, lookups); err != nil {
+		errorf("save lookups: %s", err)
+	}
+
+	if *optCheckPermissions {
+		if !checkDomainsPermissions(os.Stdout, es.forDomains(names)) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// The lookups of all domains are bounded by one -timeout, like fetching
+	// their metrics.
+	domains := es.forDomains(names)
+	ctx, cancel := es.runContext()
+	for i := range domains {
+		domains[i].resolveState(ctx, *optTempfile, key)
+	}
+	cancel()
+	if *optJSON {
+		if err := writeJSON(os.Stdout, domains); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if *optFormat == formatPrometheus {
+		if err := writePrometheus(os.Stdout, domains); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	helper := mp.NewMackerelPlugin(newPlugin(domains))
 	helper.Tempfile = *optTempfile
 
 	helper.Run()
@@ -0,0 +1,637 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func TestValueFromDatapoint(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric metrics
+		value  float64
+		want   float64
+	}{
+		{"average", metrics{Name: "CPUUtilization", Type: metricsTypeAverage}, 12.5, 12.5},
+		{"sum", metrics{Name: "AutomatedSnapshotFailure", Type: metricsTypeSum}, 3, 3},
+		{"maximum", metrics{Name: "JVMMemoryPressure", Type: metricsTypeMaximum}, 75.25, 75.25},
+		{"minimum", metrics{Name: "ClusterStatus.green", Type: metricsTypeMinimum}, 1, 1},
+		{"ClusterUsedSpace in MB", metrics{Name: "ClusterUsedSpace", Type: metricsTypeMinimum}, 2, 2 * 1024 * 1024},
+		{"FreeStorageSpace in MB", metrics{Name: "FreeStorageSpace", Type: metricsTypeMinimum}, 1.5, 1.5 * 1024 * 1024},
+		{"MasterFreeStorageSpace in MB", metrics{Name: "MasterFreeStorageSpace", Type: metricsTypeMinimum}, 10, 10 * 1024 * 1024},
+		{"WarmFreeStorageSpace in MB", metrics{Name: "WarmFreeStorageSpace", Type: metricsTypeMinimum}, 0.5, 0.5 * 1024 * 1024},
+		{"other storage metric", metrics{Name: "WarmStorageSpaceUtilization", Type: metricsTypeAverage}, 10, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dp := &datapoint{Timestamp: time.Now(), Value: tt.value}
+			if got := valueFromDatapoint(dp, tt.metric); got != tt.want {
+				t.Errorf("valueFromDatapoint(%g, %s) = %g, want %g", tt.value, tt.metric.Name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeStatFromDatapoint(t *testing.T) {
+	tests := []struct {
+		name   string
+		dp     *datapoint
+		metric metrics
+		want   map[string]float64
+	}{
+		{
+			name:   "average",
+			dp:     &datapoint{Value: 2.5},
+			metric: metrics{Name: "Nodes", Type: metricsTypeAverage},
+			want:   map[string]float64{"Nodes": 2.5},
+		},
+		{
+			name:   "sum",
+			dp:     &datapoint{Value: 7},
+			metric: metrics{Name: "AutomatedSnapshotFailure", Type: metricsTypeSum},
+			want:   map[string]float64{"AutomatedSnapshotFailure": 7},
+		},
+		{
+			name:   "maximum",
+			dp:     &datapoint{Value: 1},
+			metric: metrics{Name: "ClusterStatus.red", Type: metricsTypeMaximum},
+			want:   map[string]float64{"ClusterStatus.red": 1},
+		},
+		{
+			name:   "minimum in MB",
+			dp:     &datapoint{Value: 3},
+			metric: metrics{Name: "FreeStorageSpace", Type: metricsTypeMinimum},
+			want:   map[string]float64{"FreeStorageSpace": 3 * 1024 * 1024},
+		},
+		{
+			name:   "key",
+			dp:     &datapoint{Value: 4},
+			metric: metrics{Name: "5xx", Type: metricsTypeSum, Key: "http_5xx"},
+			want:   map[string]float64{"http_5xx": 4},
+		},
+		{
+			name:   "nil datapoint",
+			dp:     nil,
+			metric: metrics{Name: "Nodes", Type: metricsTypeAverage},
+			want:   map[string]float64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeStatFromDatapoint(map[string]float64{}, tt.dp, tt.metric)
+			if len(got) != len(tt.want) {
+				t.Fatalf("mergeStatFromDatapoint() = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("mergeStatFromDatapoint()[%q] = %g, want %g", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeStatFromDatapointKeepsOthers(t *testing.T) {
+	stat := map[string]float64{"Nodes": 3}
+	stat = mergeStatFromDatapoint(stat, nil, metrics{Name: "CPUUtilization", Type: metricsTypeMaximum})
+	stat = mergeStatFromDatapoint(stat, &datapoint{Value: 40}, metrics{Name: "CPUUtilization", Type: metricsTypeMaximum})
+	if stat["Nodes"] != 3 || stat["CPUUtilization"] != 40 {
+		t.Errorf("stat = %v, want Nodes 3 and CPUUtilization 40", stat)
+	}
+}
+
+func TestGetLastPointsFromCloudWatchBatches(t *testing.T) {
+	var queries []metricQuery
+	for i := range 1200 {
+		queries = append(queries, metricQuery{metric: metrics{Name: fmt.Sprintf("M%d", i), Type: metricsTypeAverage}})
+	}
+	queries = append(queries,
+		metricQuery{metric: metrics{Name: "AutomatedSnapshotFailure", Type: metricsTypeSum, Window: 86400}},
+		metricQuery{metric: metrics{Name: "Daily", Type: metricsTypeSum, Window: 86400}},
+	)
+	cw := &fakeCloudWatch{}
+	p := ESPlugin{CloudWatch: cw, Period: 60, Lookback: 180, Concurrency: 3}
+
+	points, err := p.getLastPointsFromCloudWatch(context.Background(), queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, dp := range points {
+		if dp == nil || dp.Value != float64(i) {
+			t.Fatalf("points[%d] = %v, want the datapoint of m%d", i, dp, i)
+		}
+	}
+
+	sizes := make(map[time.Duration][]int)
+	for _, in := range cw.calls() {
+		lookback := in.EndTime.Sub(*in.StartTime)
+		sizes[lookback] = append(sizes[lookback], len(in.MetricDataQueries))
+	}
+	for _, s := range sizes {
+		slices.Sort(s)
+	}
+	want := map[time.Duration][]int{
+		180 * time.Second:   {200, 500, 500},
+		86400 * time.Second: {2},
+	}
+	if !maps.EqualFunc(sizes, want, slices.Equal) {
+		t.Errorf("queries per call by lookback = %v, want %v", sizes, want)
+	}
+}
+
+func TestGetLastPointsFromCloudWatchInternalError(t *testing.T) {
+	cw := &fakeCloudWatch{
+		getMetricData: func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+			pages, _ := answerQueries(in)
+			for _, r := range pages[0].MetricDataResults {
+				if aws.StringValue(r.Id) == "m1" {
+					r.StatusCode = aws.String(cloudwatch.StatusCodeInternalError)
+					r.Timestamps, r.Values = nil, nil
+				}
+			}
+			return pages, nil
+		},
+	}
+	p := ESPlugin{CloudWatch: cw, Period: 60, Lookback: 180}
+	queries := []metricQuery{
+		{metric: metrics{Name: "Nodes", Type: metricsTypeAverage}},
+		{metric: metrics{Name: "CPUUtilization", Type: metricsTypeMaximum}},
+	}
+
+	points, err := p.getLastPointsFromCloudWatch(context.Background(), queries)
+	if err == nil || !strings.Contains(err.Error(), "CPUUtilization: internal error") {
+		t.Errorf("err = %v, want the internal error of CPUUtilization", err)
+	}
+	if points[0] == nil || points[0].Value != 0 {
+		t.Errorf("points[0] = %v, want the datapoint of Nodes", points[0])
+	}
+	if points[1] != nil {
+		t.Errorf("points[1] = %v, want nil", points[1])
+	}
+}
+
+func TestGetLastPointsFromCloudWatchJoinsErrors(t *testing.T) {
+	errMinutely := errors.New("minutely failed")
+	errDaily := errors.New("daily failed")
+	cw := &fakeCloudWatch{
+		getMetricData: func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+			pages, _ := answerQueries(in)
+			if in.EndTime.Sub(*in.StartTime) == 86400*time.Second {
+				return pages, errDaily
+			}
+			return nil, errMinutely
+		},
+	}
+	p := ESPlugin{CloudWatch: cw, Period: 60, Lookback: 180, Concurrency: 2}
+	queries := []metricQuery{
+		{metric: metrics{Name: "Nodes", Type: metricsTypeAverage}},
+		{metric: metrics{Name: "AutomatedSnapshotFailure", Type: metricsTypeSum, Window: 86400}},
+	}
+
+	points, err := p.getLastPointsFromCloudWatch(context.Background(), queries)
+	if !errors.Is(err, errMinutely) || !errors.Is(err, errDaily) {
+		t.Errorf("err = %v, want both errors joined", err)
+	}
+	if points[0] != nil {
+		t.Errorf("points[0] = %v, want nil", points[0])
+	}
+	// Pages received before an error are kept.
+	if points[1] == nil || points[1].Value != 1 {
+		t.Errorf("points[1] = %v, want the datapoint of AutomatedSnapshotFailure", points[1])
+	}
+}
+
+func TestRefetchMissing(t *testing.T) {
+	queries := []metricQuery{
+		{metric: metrics{Name: "Nodes", Type: metricsTypeAverage}},
+		{metric: metrics{Name: "CPUUtilization", Type: metricsTypeAverage}},
+		{metric: metrics{Name: "FreeStorageSpace", Type: metricsTypeMinimum}},
+	}
+	// Nodes has a datapoint in -lookback, CPUUtilization only in the wider
+	// window and FreeStorageSpace in neither.
+	answer := func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+		if in.EndTime.Sub(*in.StartTime) == adaptiveLookback*time.Second {
+			return answerByName(map[string]float64{"Nodes": 3, "CPUUtilization": 40})(in)
+		}
+		return answerByName(map[string]float64{"Nodes": 3})(in)
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		cw := &fakeCloudWatch{getMetricData: answer}
+		p := ESPlugin{CloudWatch: cw, Period: 60, Lookback: 180, Concurrency: 1}
+		points, err := p.getLastPointsFromCloudWatch(context.Background(), queries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.refetchMissing(context.Background(), queries, points); err != nil {
+			t.Fatal(err)
+		}
+
+		calls := cw.calls()
+		if len(calls) != 2 {
+			t.Fatalf("%d calls, want 2", len(calls))
+		}
+		refetch := calls[1]
+		if window := refetch.EndTime.Sub(*refetch.StartTime); window != adaptiveLookback*time.Second {
+			t.Errorf("refetched over %s, want %ds", window, adaptiveLookback)
+		}
+		var names []string
+		for _, q := range refetch.MetricDataQueries {
+			names = append(names, aws.StringValue(q.MetricStat.Metric.MetricName))
+		}
+		if want := []string{"CPUUtilization", "FreeStorageSpace"}; !slices.Equal(names, want) {
+			t.Errorf("refetched %v, want %v", names, want)
+		}
+
+		if points[0] == nil || points[0].Value != 3 {
+			t.Errorf("points[0] = %v, want the datapoint of Nodes", points[0])
+		}
+		if points[1] == nil || points[1].Value != 40 {
+			t.Errorf("points[1] = %v, want the datapoint of CPUUtilization found in the wider window", points[1])
+		}
+		if points[2] != nil {
+			t.Errorf("points[2] = %v, want nil", points[2])
+		}
+	})
+
+	t.Run("nothing missing", func(t *testing.T) {
+		cw := &fakeCloudWatch{getMetricData: answer}
+		p := ESPlugin{CloudWatch: cw, Period: 60, Lookback: 180, Concurrency: 1}
+		points := []*datapoint{{Value: 1}, {Value: 2}, {Value: 3}}
+		if err := p.refetchMissing(context.Background(), queries, points); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(cw.calls()); n != 0 {
+			t.Errorf("%d calls, want none", n)
+		}
+	})
+
+	t.Run("lookback as wide", func(t *testing.T) {
+		cw := &fakeCloudWatch{getMetricData: answer}
+		p := ESPlugin{CloudWatch: cw, Period: 60, Lookback: adaptiveLookback, Concurrency: 1}
+		points := make([]*datapoint, len(queries))
+		if err := p.refetchMissing(context.Background(), queries, points); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(cw.calls()); n != 0 {
+			t.Errorf("%d calls, want none", n)
+		}
+	})
+}
+
+func TestLatestDatapoint(t *testing.T) {
+	at := func(minutes int) *time.Time {
+		return aws.Time(fakeTime.Add(time.Duration(minutes) * time.Minute))
+	}
+	tests := []struct {
+		name   string
+		latest *datapoint
+		r      *cloudwatch.MetricDataResult
+		want   *datapoint
+	}{
+		{
+			name: "descending",
+			r: &cloudwatch.MetricDataResult{
+				Timestamps: []*time.Time{at(2), at(1), at(0)},
+				Values:     aws.Float64Slice([]float64{3, 2, 1}),
+			},
+			want: &datapoint{Timestamp: *at(2), Value: 3},
+		},
+		{
+			name: "unordered",
+			r: &cloudwatch.MetricDataResult{
+				Timestamps: []*time.Time{at(0), at(2), at(1)},
+				Values:     aws.Float64Slice([]float64{1, 3, 2}),
+			},
+			want: &datapoint{Timestamp: *at(2), Value: 3},
+		},
+		{
+			name: "nil timestamp and value",
+			r: &cloudwatch.MetricDataResult{
+				Timestamps: []*time.Time{nil, at(2), at(1)},
+				Values:     []*float64{aws.Float64(4), nil, aws.Float64(2)},
+			},
+			want: &datapoint{Timestamp: *at(1), Value: 2},
+		},
+		{
+			name: "fewer values than timestamps",
+			r: &cloudwatch.MetricDataResult{
+				Timestamps: []*time.Time{at(1), at(2)},
+				Values:     aws.Float64Slice([]float64{2}),
+			},
+			want: &datapoint{Timestamp: *at(1), Value: 2},
+		},
+		{
+			name: "no datapoint",
+			r:    &cloudwatch.MetricDataResult{},
+			want: nil,
+		},
+		{
+			name:   "earlier page is newer",
+			latest: &datapoint{Timestamp: *at(5), Value: 6},
+			r: &cloudwatch.MetricDataResult{
+				Timestamps: []*time.Time{at(1), at(2)},
+				Values:     aws.Float64Slice([]float64{2, 3}),
+			},
+			want: &datapoint{Timestamp: *at(5), Value: 6},
+		},
+		{
+			name:   "later page is newer",
+			latest: &datapoint{Timestamp: *at(1), Value: 2},
+			r: &cloudwatch.MetricDataResult{
+				Timestamps: []*time.Time{at(3)},
+				Values:     aws.Float64Slice([]float64{4}),
+			},
+			want: &datapoint{Timestamp: *at(3), Value: 4},
+		},
+		{
+			name:   "earlier page and empty page",
+			latest: &datapoint{Timestamp: *at(1), Value: 2},
+			r:      &cloudwatch.MetricDataResult{},
+			want:   &datapoint{Timestamp: *at(1), Value: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := latestDatapoint(tt.latest, tt.r)
+			switch {
+			case got == nil && tt.want == nil:
+			case got == nil || tt.want == nil || !got.Timestamp.Equal(tt.want.Timestamp) || got.Value != tt.want.Value:
+				t.Errorf("latestDatapoint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetLastPointsFromCloudWatchAcrossPages(t *testing.T) {
+	page := func(minutes int, value float64) *cloudwatch.GetMetricDataOutput {
+		return &cloudwatch.GetMetricDataOutput{MetricDataResults: []*cloudwatch.MetricDataResult{{
+			Id:         aws.String("m0"),
+			StatusCode: aws.String(cloudwatch.StatusCodePartialData),
+			Timestamps: []*time.Time{aws.Time(fakeTime.Add(time.Duration(minutes) * time.Minute))},
+			Values:     aws.Float64Slice([]float64{value}),
+		}}}
+	}
+	cw := &fakeCloudWatch{
+		getMetricData: func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+			return []*cloudwatch.GetMetricDataOutput{page(1, 2), page(3, 4), page(2, 3)}, nil
+		},
+	}
+	p := ESPlugin{CloudWatch: cw, Period: 60, Lookback: 180}
+
+	points, err := p.getLastPointsFromCloudWatch(context.Background(), []metricQuery{
+		{metric: metrics{Name: "Nodes", Type: metricsTypeAverage}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points[0] == nil || points[0].Value != 4 {
+		t.Errorf("points[0] = %v, want the datapoint of the second page", points[0])
+	}
+}
+
+func TestFetchMetricsErrorRate(t *testing.T) {
+	tests := []struct {
+		engine string
+		values map[string]float64
+		want   float64
+	}{
+		{engineElasticsearch, map[string]float64{"5xx": 5, "ElasticsearchRequests": 50}, 10},
+		{engineOpenSearch, map[string]float64{"5xx": 5, "OpenSearchRequests": 100}, 5},
+		// Both are fetched when the engine could not be told.
+		{"", map[string]float64{"5xx": 1, "OpenSearchRequests": 4}, 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.engine, func(t *testing.T) {
+			cw := &fakeCloudWatch{getMetricData: answerByName(tt.values)}
+			p := ESPlugin{Domain: "d", CloudWatch: cw, Engine: tt.engine, Period: 60, Lookback: 180}
+			stat, err := p.FetchMetrics()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := stat["http_5xxErrorRate"]; !ok || got != tt.want {
+				t.Errorf("http_5xxErrorRate = %g (%v), want %g", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchMetricsTimeout(t *testing.T) {
+	captureLog(t)
+	cw := &fakeCloudWatch{stuck: true}
+	p := ESPlugin{Domain: "d", CloudWatch: cw, Engine: engineElasticsearch, Period: 60, Lookback: 180, Concurrency: 2, Timeout: 50 * time.Millisecond}
+	start := time.Now()
+	ctx, cancel := p.runContext()
+	defer cancel()
+	_, fetched, err := p.fetchMetrics(ctx)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("fetchMetrics returned after %s, want about the timeout", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if len(fetched) > 0 {
+		t.Errorf("fetched %d metrics, want none", len(fetched))
+	}
+}
+
+func TestCheckStatOverrides(t *testing.T) {
+	tests := []struct {
+		override string
+		warn     bool
+	}{
+		{"CPUUtilization=Average", false},
+		{"CPUUtilization=Sum", true},
+		{"FreeStorageSpace=Maximum", false},
+		{"FreeStorageSpace=Average", true},
+		// Gauges graphed as integer.
+		{"Nodes=Minimum", false},
+		{"Nodes=Maximum", false},
+		{"Nodes=Sum", true},
+		{"ClusterStatus.green=Maximum", false},
+		{"Shards.unassigned=Average", false},
+		{"ThreadpoolSearchQueue=Average", false},
+		{"ThreadpoolSearchQueue=Sum", true},
+		// Counters graphed as integer.
+		{"5xx=Maximum", true},
+		{"ElasticsearchRequests=Average", true},
+		// The built-in statistic is always fine.
+		{"5xx=Sum", false},
+		{"MasterReachableFromNode=Minimum", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.override, func(t *testing.T) {
+			overrides, err := parseStatOverrides(tt.override)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := captureLog(t)
+			ESPlugin{StatOverrides: overrides}.checkStatOverrides()
+			if warned := strings.Contains(buf.String(), "warning:"); warned != tt.warn {
+				t.Errorf("warned = %v, want %v; log: %q", warned, tt.warn, buf.String())
+			}
+		})
+	}
+}
+
+func TestStorageGraphDefinition(t *testing.T) {
+	cw := &fakeCloudWatch{getMetricData: answerByName(map[string]float64{"FreeStorageSpace": 1, "ClusterUsedSpace": 1})}
+	p := ESPlugin{Domain: "d", CloudWatch: cw, Engine: engineElasticsearch, Period: 60, Lookback: 180}
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := p.GraphDefinition()["Storage"]
+	var names []string
+	for _, m := range g.Metrics {
+		if !m.Stacked {
+			t.Errorf("%s is not stacked", m.Name)
+		}
+		if _, ok := stat[m.Name]; !ok {
+			t.Errorf("%s of the Storage graph is not fetched", m.Name)
+		}
+		names = append(names, m.Name)
+	}
+	if want := []string{"ClusterUsedSpace", "sum.FreeStorageSpace"}; !slices.Equal(names, want) {
+		t.Errorf("Storage graph stacks %v, want %v", names, want)
+	}
+}
+
+// shortenBackoff makes the throttled batches wait milliseconds for the test.
+func shortenBackoff(t *testing.T) {
+	t.Helper()
+	backoff, maxBackoff := throttleBackoff, maxThrottleBackoff
+	throttleBackoff, maxThrottleBackoff = time.Millisecond, 4*time.Millisecond
+	t.Cleanup(func() {
+		throttleBackoff, maxThrottleBackoff = backoff, maxBackoff
+	})
+}
+
+// throttleTimes answers the first n calls with a Throttling error and the
+// others with answerQueries.
+func throttleTimes(n int) func(*cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+	calls := 0
+	return func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+		calls++
+		if calls <= n {
+			return nil, awserr.New("Throttling", "Rate exceeded", nil)
+		}
+		return answerQueries(in)
+	}
+}
+
+func TestIsThrottled(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{awserr.New("Throttling", "Rate exceeded", nil), true},
+		{awserr.New("ThrottlingException", "Rate exceeded", nil), true},
+		{errors.Join(errors.New("CPUUtilization: internal error"), awserr.New("Throttling", "Rate exceeded", nil)), true},
+		{awserr.New("AccessDenied", "denied", nil), false},
+		{errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		if got := isThrottled(tt.err); got != tt.want {
+			t.Errorf("isThrottled(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestGetMetricDataBatchThrottled(t *testing.T) {
+	queries := []metricQuery{{metric: metrics{Name: "CPUUtilization", Type: metricsTypeAverage}}}
+	waitReg := regexp.MustCompile(`again in (\S+)`)
+
+	t.Run("retried until it succeeds", func(t *testing.T) {
+		shortenBackoff(t)
+		logs := captureLog(t)
+		cw := &fakeCloudWatch{getMetricData: throttleTimes(5)}
+		p := ESPlugin{Domain: "d", CloudWatch: cw, Period: 60, Lookback: 180, Verbose: true}
+		points := make([]*datapoint, len(queries))
+		if err := p.getMetricDataBatchThrottled(context.Background(), queries, points, []int{0}, fakeTime); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(cw.calls()); n != 6 {
+			t.Errorf("%d calls, want 6", n)
+		}
+		if points[0] == nil {
+			t.Error("no datapoint after the retries")
+		}
+		waits := waitReg.FindAllStringSubmatch(logs.String(), -1)
+		if len(waits) != 5 {
+			t.Fatalf("%d waits logged, want 5:\n%s", len(waits), logs)
+		}
+		// The bound doubles with every throttling, up to the maximum.
+		bound := throttleBackoff
+		for i, m := range waits {
+			if wait, err := time.ParseDuration(m[1]); err != nil || wait >= bound {
+				t.Errorf("wait %d is %s, want less than %s", i+1, m[1], bound)
+			}
+			bound = min(bound*2, maxThrottleBackoff)
+		}
+	})
+
+	t.Run("other errors are not retried", func(t *testing.T) {
+		cw := &fakeCloudWatch{getMetricData: func(*cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+			return nil, awserr.New("AccessDenied", "denied", nil)
+		}}
+		p := ESPlugin{Domain: "d", CloudWatch: cw, Period: 60, Lookback: 180}
+		err := p.getMetricDataBatchThrottled(context.Background(), queries, make([]*datapoint, len(queries)), []int{0}, fakeTime)
+		if !isAccessDenied(err) {
+			t.Errorf("err = %v, want the AccessDenied error", err)
+		}
+		if n := len(cw.calls()); n != 1 {
+			t.Errorf("%d calls, want one", n)
+		}
+	})
+
+	t.Run("gives up at the timeout", func(t *testing.T) {
+		shortenBackoff(t)
+		cw := &fakeCloudWatch{getMetricData: throttleTimes(1 << 30)}
+		p := ESPlugin{Domain: "d", CloudWatch: cw, Period: 60, Lookback: 180, Timeout: 50 * time.Millisecond}
+		ctx, cancel := p.runContext()
+		defer cancel()
+		start := time.Now()
+		err := p.getMetricDataBatchThrottled(ctx, queries, make([]*datapoint, len(queries)), []int{0}, fakeTime)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("returned after %s, want about the timeout", elapsed)
+		}
+		// The deadline can also pass while the batch is fetched again.
+		if !isThrottled(err) && !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err = %v, want the Throttling error or the deadline", err)
+		}
+		if n := len(cw.calls()); n < 2 {
+			t.Errorf("%d calls, want retries until the timeout", n)
+		}
+	})
+
+	t.Run("stops when canceled", func(t *testing.T) {
+		// The backoff is not shortened, so the wait is canceled.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		throttle := throttleTimes(1 << 30)
+		cw := &fakeCloudWatch{getMetricData: func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+			cancel()
+			return throttle(in)
+		}}
+		p := ESPlugin{Domain: "d", CloudWatch: cw, Period: 60, Lookback: 180}
+		err := p.getMetricDataBatchThrottled(ctx, queries, make([]*datapoint, len(queries)), []int{0}, fakeTime)
+		if err == nil || !strings.Contains(err.Error(), "Throttling") {
+			t.Errorf("err = %v, want the Throttling error", err)
+		}
+		if n := len(cw.calls()); n != 1 {
+			t.Errorf("%d calls, want none after the cancellation", n)
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package mpawselasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// envPrefix prefixes the environment variables flags fall back to, e.g.
+// MACKEREL_ES_DOMAIN for -domain.
+const envPrefix = "MACKEREL_ES_"
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// flagAliases maps the alternative names of flags to the flag they set.
+var flagAliases = map[string]string{
+	"endpoint-url": "endpoint",
+}
+
+// markGiven records the flag as given under all of its names, so that a
+// value for an alias does not override the flag and vice versa.
+func markGiven(given map[string]bool, name string) {
+	if target, ok := flagAliases[name]; ok {
+		name = target
+	}
+	given[name] = true
+	for alias, target := range flagAliases {
+		if target == name {
+			given[alias] = true
+		}
+	}
+}
+
+// givenFlags returns the names of the flags set so far, with their aliases.
+func givenFlags(fs *flag.FlagSet) map[string]bool {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		markGiven(given, f.Name)
+	})
+	return given
+}
+
+// applyEnvironment sets the flags not given on the command line from their
+// environment variables.
+func applyEnvironment(fs *flag.FlagSet) error {
+	given := givenFlags(fs)
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("invalid %s: %w", envName(f.Name), e)
+		}
+		markGiven(given, f.Name)
+	})
+	return err
+}
+
+// applyConfigFile sets the flags not given on the command line or in the
+// environment from a JSON object keyed by flag name, e.g.
+// {"domain": "logs", "top-n": 3}. An array sets a repeatable flag once per
+// element.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	given := givenFlags(fs)
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s: unknown flag %q", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		v := values[name]
+		elems, ok := v.([]any)
+		if !ok {
+			elems = []any{v}
+		}
+		for _, e := range elems {
+			switch e.(type) {
+			case string, json.Number, bool:
+			default:
+				return fmt.Errorf("%s: invalid value of %s: expected a string, number or boolean", path, name)
+			}
+			if err := fs.Set(name, fmt.Sprint(e)); err != nil {
+				return fmt.Errorf("%s: invalid value of %s: %w", path, name, err)
+			}
+		}
+		markGiven(given, name)
+	}
+	return nil
+}
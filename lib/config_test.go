@@ -0,0 +1,125 @@
+package mpawselasticsearch
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAliasPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		config string
+		want   string
+	}{
+		{
+			name: "flag over alias in the environment",
+			args: []string{"-endpoint=cli"},
+			env:  map[string]string{"MACKEREL_ES_ENDPOINT_URL": "env"},
+			want: "cli",
+		},
+		{
+			name: "alias over flag in the environment",
+			args: []string{"-endpoint-url=cli"},
+			env:  map[string]string{"MACKEREL_ES_ENDPOINT": "env"},
+			want: "cli",
+		},
+		{
+			name:   "flag over alias in the config file",
+			args:   []string{"-endpoint=cli"},
+			config: `{"endpoint-url": "config"}`,
+			want:   "cli",
+		},
+		{
+			name:   "environment over alias in the config file",
+			env:    map[string]string{"MACKEREL_ES_ENDPOINT": "env"},
+			config: `{"endpoint-url": "config"}`,
+			want:   "env",
+		},
+		{
+			name: "alias in the environment",
+			env:  map[string]string{"MACKEREL_ES_ENDPOINT_URL": "env"},
+			want: "env",
+		},
+		{
+			name:   "alias in the config file",
+			config: `{"endpoint-url": "config"}`,
+			want:   "config",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			endpoint := fs.String("endpoint", "", "")
+			fs.StringVar(endpoint, "endpoint-url", "", "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyEnvironment(fs); err != nil {
+				t.Fatal(err)
+			}
+			if tt.config != "" {
+				path := filepath.Join(t.TempDir(), "config.json")
+				if err := os.WriteFile(path, []byte(tt.config), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := applyConfigFile(fs, path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if *endpoint != tt.want {
+				t.Errorf("endpoint = %q, want %q", *endpoint, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlagsKey(t *testing.T) {
+	key := func(args []string, env map[string]string) string {
+		t.Helper()
+		for k, v := range env {
+			t.Setenv(k, v)
+		}
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.String("role-arn", "", "")
+		fs.String("domain", "", "")
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyEnvironment(fs); err != nil {
+			t.Fatal(err)
+		}
+		return flagsKey(fs)
+	}
+	args := []string{"-domain=logs"}
+	base := key(args, nil)
+	if got := key(args, nil); got != base {
+		t.Errorf("flagsKey() = %s for the same flags, want %s", got, base)
+	}
+	// The environment variables are set for the rest of the test.
+	if got := key(nil, map[string]string{"MACKEREL_ES_DOMAIN": "logs"}); got != base {
+		t.Errorf("flagsKey() = %s with -domain from the environment, want %s as on the command line", got, base)
+	}
+	if got := key(args, map[string]string{"MACKEREL_ES_ROLE_ARN": "arn:aws:iam::123456789012:role/a"}); got == base {
+		t.Error("flagsKey() does not change with MACKEREL_ES_ROLE_ARN")
+	}
+}
+
+func TestLoadLookupCacheKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lookups")
+	if err := saveLookupCache(path, lookupCache{Key: "a", ClientID: "123456789012", Runs: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if c := loadLookupCache(path, "a"); c.ClientID != "123456789012" {
+		t.Errorf("ClientID = %q with the same key, want the cached one", c.ClientID)
+	}
+	if c := loadLookupCache(path, "b"); c.ClientID != "" || c.Key != "b" {
+		t.Errorf("loadLookupCache() = %+v with another key, want an empty cache keyed b", c)
+	}
+}
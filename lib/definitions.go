@@ -0,0 +1,92 @@
+package mpawselasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// metricDefinition declares a metric to fetch and the graph it is drawn in.
+type metricDefinition struct {
+	Name      string  `json:"name"`
+	Statistic string  `json:"statistic"`
+	Graph     string  `json:"graph"`
+	Label     string  `json:"label"`
+	Unit      string  `json:"unit"`
+	Scale     float64 `json:"scale"`
+	Period    int64   `json:"period"`
+}
+
+// metricDefinitionFile is the format of -metrics-from-file.
+// When Replace is false the definitions are added to the built-in metrics.
+type metricDefinitionFile struct {
+	Replace bool               `json:"replace"`
+	Metrics []metricDefinition `json:"metrics"`
+}
+
+var graphUnits = map[string]bool{
+	"float":        true,
+	"integer":      true,
+	"percentage":   true,
+	"seconds":      true,
+	"milliseconds": true,
+	"bytes":        true,
+	"bytes/sec":    true,
+	"bits/sec":     true,
+	"iops":         true,
+}
+
+func loadMetricDefinitions(path string) (*metricDefinitionFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var defs metricDefinitionFile
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&defs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := defs.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &defs, nil
+}
+
+func (defs *metricDefinitionFile) validate() error {
+	if len(defs.Metrics) == 0 {
+		return fmt.Errorf("no metrics defined")
+	}
+	names := make(map[string]bool)
+	if !defs.Replace {
+		for _, met := range defaultMetrics {
+			names[met.Name] = true
+		}
+	}
+	units := make(map[string]string)
+	for i, def := range defs.Metrics {
+		if def.Name == "" || def.Graph == "" {
+			return fmt.Errorf("metrics[%d]: name and graph are required", i)
+		}
+		if names[def.Name] {
+			return fmt.Errorf("metrics[%d]: %s is defined more than once", i, def.Name)
+		}
+		names[def.Name] = true
+		if !isValidStatistic(def.Statistic) {
+			return fmt.Errorf("metrics[%d]: invalid statistic %q for %s", i, def.Statistic, def.Name)
+		}
+		if def.Period < 0 || def.Period%60 != 0 {
+			return fmt.Errorf("metrics[%d]: invalid period %d for %s: must be a multiple of 60", i, def.Period, def.Name)
+		}
+		if !graphUnits[def.Unit] {
+			return fmt.Errorf("metrics[%d]: invalid unit %q for %s", i, def.Unit, def.Name)
+		}
+		if u, ok := units[def.Graph]; ok && u != def.Unit {
+			return fmt.Errorf("metrics[%d]: graph %s already has unit %s", i, def.Graph, u)
+		}
+		units[def.Graph] = def.Unit
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/opensearchservice"
+)
+
+// Engines a domain can run.
+const (
+	engineAuto          = "auto"
+	engineElasticsearch = "es"
+	engineOpenSearch    = "opensearch"
+)
+
+// errDescribeDenied is returned once the credentials turned out not to be
+// allowed to describe the domain.
+var errDescribeDenied = errors.New("not allowed to describe the domain")
+
+func isAccessDenied(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	switch aerr.Code() {
+	case "AccessDenied", "AccessDeniedException":
+		return true
+	}
+	return false
+}
+
+// describeDomain calls the describe API for the domain. When the call is
+// denied it warns once and returns errDescribeDenied from then on, so features
+// depending on it can be skipped while CloudWatch metrics are still collected.
+func (p *ESPlugin) describeDomain(ctx context.Context) (*opensearchservice.DomainStatus, error) {
+	if p.describeDenied {
+		return nil, errDescribeDenied
+	}
+	out, err := p.OpenSearch.DescribeDomainWithContext(ctx, &opensearchservice.DescribeDomainInput{
+		DomainName: aws.String(p.Domain),
+	})
+	if err != nil {
+		if isAccessDenied(err) {
+			p.describeDenied = true
+			warnf("es:DescribeDomain is denied for %s; features depending on it are disabled for this run", p.Domain)
+			return nil, errDescribeDenied
+		}
+		return nil, err
+	}
+	return out.DomainStatus, nil
+}
+
+// listDomains returns the names of the domains of both engines in the region.
+func (p ESPlugin) listDomains() ([]string, error) {
+	ctx, cancel := p.runContext()
+	defer cancel()
+	out, err := p.OpenSearch.ListDomainNamesWithContext(ctx, &opensearchservice.ListDomainNamesInput{})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, d := range out.DomainNames {
+		names = append(names, aws.StringValue(d.DomainName))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func engineFromVersion(version string) string {
+	if strings.HasPrefix(version, "OpenSearch_") {
+		return engineOpenSearch
+	}
+	return engineElasticsearch
+}
+
+// resolveEngine settles p.Engine when it is auto, preferring the engine cached
+// in st until lookupRefreshRuns runs used it. When the domain cannot be
+// described the cached engine is kept, and without one the engine is left
+// empty and the metrics of both engines are fetched.
+func (p *ESPlugin) resolveEngine(ctx context.Context, st *pluginState) {
+	if p.Engine != engineAuto {
+		return
+	}
+	p.Engine = st.Engine
+	if st.Engine != "" && st.EngineRuns < lookupRefreshRuns {
+		st.EngineRuns++
+		return
+	}
+	status, err := p.describeDomain(ctx)
+	if err != nil {
+		if err != errDescribeDenied {
+			errorf("describe domain %s: %s", p.Domain, err)
+		}
+		return
+	}
+	p.Engine = engineFromVersion(aws.StringValue(status.EngineVersion))
+	st.Engine = p.Engine
+	st.EngineRuns = 1
+}
@@ -0,0 +1,208 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/opensearchservice"
+)
+
+func TestEngineFromVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{"OpenSearch_2.11", engineOpenSearch},
+		{"OpenSearch_1.0", engineOpenSearch},
+		{"Elasticsearch_7.10", engineElasticsearch},
+		{"7.10", engineElasticsearch},
+		{"", engineElasticsearch},
+	}
+	for _, tt := range tests {
+		if got := engineFromVersion(tt.version); got != tt.want {
+			t.Errorf("engineFromVersion(%q) = %q, want %q", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestDescribeDomainDenied(t *testing.T) {
+	logs := captureLog(t)
+	api := &fakeOpenSearch{describeDomain: func(*opensearchservice.DescribeDomainInput) (*opensearchservice.DescribeDomainOutput, error) {
+		return nil, awserr.New("AccessDeniedException", "not authorized to perform es:DescribeDomain", nil)
+	}}
+	p := &ESPlugin{Domain: "d", OpenSearch: api}
+	for call := range 3 {
+		if _, err := p.describeDomain(context.Background()); err != errDescribeDenied {
+			t.Fatalf("call %d: err = %v, want errDescribeDenied", call, err)
+		}
+	}
+	if api.describeDomainCalled != 1 {
+		t.Errorf("DescribeDomain is called %d times, want once", api.describeDomainCalled)
+	}
+	if n := strings.Count(logs.String(), "warning: "); n != 1 {
+		t.Errorf("%d warnings are logged, want one:\n%s", n, logs)
+	}
+}
+
+func TestDescribeDomainError(t *testing.T) {
+	captureLog(t)
+	api := &fakeOpenSearch{describeDomain: func(*opensearchservice.DescribeDomainInput) (*opensearchservice.DescribeDomainOutput, error) {
+		return nil, awserr.New("ResourceNotFoundException", "domain not found", nil)
+	}}
+	p := &ESPlugin{Domain: "d", OpenSearch: api}
+	for call := range 2 {
+		if _, err := p.describeDomain(context.Background()); err == nil || err == errDescribeDenied {
+			t.Fatalf("call %d: err = %v, want the error of DescribeDomain", call, err)
+		}
+	}
+	if api.describeDomainCalled != 2 {
+		t.Errorf("DescribeDomain is called %d times, want twice", api.describeDomainCalled)
+	}
+}
+
+func TestResolveEngine(t *testing.T) {
+	denied := func(*opensearchservice.DescribeDomainInput) (*opensearchservice.DescribeDomainOutput, error) {
+		return nil, awserr.New("AccessDeniedException", "denied", nil)
+	}
+	failing := func(*opensearchservice.DescribeDomainInput) (*opensearchservice.DescribeDomainOutput, error) {
+		return nil, errors.New("connection reset")
+	}
+	tests := []struct {
+		name      string
+		engine    string
+		cached    string
+		runs      int
+		describe  func(*opensearchservice.DescribeDomainInput) (*opensearchservice.DescribeDomainOutput, error)
+		want      string
+		wantCache string
+		wantCalls int
+	}{
+		{"es", engineAuto, "", 0, describeVersion("Elasticsearch_7.10"), engineElasticsearch, engineElasticsearch, 1},
+		{"opensearch", engineAuto, "", 0, describeVersion("OpenSearch_2.11"), engineOpenSearch, engineOpenSearch, 1},
+		{"denied", engineAuto, "", 0, denied, "", "", 1},
+		{"failing", engineAuto, "", 0, failing, "", "", 1},
+		{"cached", engineAuto, engineOpenSearch, 1, describeVersion("Elasticsearch_7.10"), engineOpenSearch, engineOpenSearch, 0},
+		{"expired", engineAuto, engineElasticsearch, lookupRefreshRuns, describeVersion("OpenSearch_2.11"), engineOpenSearch, engineOpenSearch, 1},
+		{"expired failing", engineAuto, engineElasticsearch, lookupRefreshRuns, failing, engineElasticsearch, engineElasticsearch, 1},
+		{"given", engineElasticsearch, "", 0, describeVersion("OpenSearch_2.11"), engineElasticsearch, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			api := &fakeOpenSearch{describeDomain: tt.describe}
+			p := &ESPlugin{Domain: "d", Engine: tt.engine, OpenSearch: api}
+			st := pluginState{Engine: tt.cached, EngineRuns: tt.runs}
+			p.resolveEngine(context.Background(), &st)
+			if p.Engine != tt.want {
+				t.Errorf("Engine = %q, want %q", p.Engine, tt.want)
+			}
+			if st.Engine != tt.wantCache {
+				t.Errorf("cached engine = %q, want %q", st.Engine, tt.wantCache)
+			}
+			if api.describeDomainCalled != tt.wantCalls {
+				t.Errorf("DescribeDomain is called %d times, want %d", api.describeDomainCalled, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestResolveStateCachesEngine(t *testing.T) {
+	tempfile := filepath.Join(t.TempDir(), "tmp")
+	api := &fakeOpenSearch{describeDomain: describeVersion("OpenSearch_2.11")}
+	cw := &fakeCloudWatch{getMetricData: answerByName(map[string]float64{probeMetric.Name: 1})}
+	for run := range 3 {
+		p := ESPlugin{Domain: "d", Engine: engineAuto, OpenSearch: api, CloudWatch: cw, Period: 60, Lookback: 180}
+		p.resolveState(context.Background(), tempfile, "key")
+		if p.Engine != engineOpenSearch {
+			t.Fatalf("run %d: Engine = %q, want %q", run, p.Engine, engineOpenSearch)
+		}
+	}
+	if api.describeDomainCalled != 1 {
+		t.Errorf("DescribeDomain is called %d times, want once", api.describeDomainCalled)
+	}
+}
+
+func TestResolveStateRefreshesEngine(t *testing.T) {
+	tempfile := filepath.Join(t.TempDir(), "tmp")
+	version := "Elasticsearch_7.10"
+	api := &fakeOpenSearch{describeDomain: func(in *opensearchservice.DescribeDomainInput) (*opensearchservice.DescribeDomainOutput, error) {
+		return describeVersion(version)(in)
+	}}
+	cw := &fakeCloudWatch{getMetricData: answerByName(map[string]float64{probeMetric.Name: 1})}
+	run := func() string {
+		p := ESPlugin{Domain: "d", Engine: engineAuto, OpenSearch: api, CloudWatch: cw, Period: 60, Lookback: 180}
+		p.resolveState(context.Background(), tempfile, "key")
+		return p.Engine
+	}
+	run()
+	// The domain is upgraded; the cached engine is used until it expires.
+	version = "OpenSearch_2.11"
+	for i := 1; i < lookupRefreshRuns; i++ {
+		if engine := run(); engine != engineElasticsearch {
+			t.Fatalf("run %d: Engine = %q, want the cached %q", i, engine, engineElasticsearch)
+		}
+	}
+	if api.describeDomainCalled != 1 {
+		t.Errorf("DescribeDomain is called %d times in %d runs, want once", api.describeDomainCalled, lookupRefreshRuns)
+	}
+	if engine := run(); engine != engineOpenSearch {
+		t.Errorf("Engine = %q after %d runs, want %q", engine, lookupRefreshRuns, engineOpenSearch)
+	}
+	if api.describeDomainCalled != 2 {
+		t.Errorf("DescribeDomain is called %d times, want twice", api.describeDomainCalled)
+	}
+}
+
+func TestResolveEngineTimeout(t *testing.T) {
+	captureLog(t)
+	api := &fakeOpenSearch{stuck: true}
+	p := &ESPlugin{Domain: "d", Engine: engineAuto, OpenSearch: api, Timeout: 50 * time.Millisecond}
+	var st pluginState
+	start := time.Now()
+	ctx, cancel := p.runContext()
+	defer cancel()
+	p.resolveEngine(ctx, &st)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("resolveEngine returned after %s, want about the timeout", elapsed)
+	}
+	if p.Engine != "" || st.Engine != "" {
+		t.Errorf("Engine = %q, cached %q, want both empty", p.Engine, st.Engine)
+	}
+}
+
+func TestMetricListEngine(t *testing.T) {
+	tests := []struct {
+		engine string
+		want   []string
+		absent []string
+	}{
+		{engineElasticsearch, []string{"ElasticsearchRequests", "CPUUtilization"}, []string{"OpenSearchRequests"}},
+		{engineOpenSearch, []string{"OpenSearchRequests", "CPUUtilization"}, []string{"ElasticsearchRequests"}},
+		{"", []string{"ElasticsearchRequests", "OpenSearchRequests", "CPUUtilization"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.engine, func(t *testing.T) {
+			p := ESPlugin{Engine: tt.engine}
+			var names []string
+			for _, met := range p.metricList() {
+				names = append(names, met.Name)
+			}
+			for _, name := range tt.want {
+				if !slices.Contains(names, name) {
+					t.Errorf("%s is not in the metrics of %q", name, tt.engine)
+				}
+			}
+			for _, name := range tt.absent {
+				if slices.Contains(names, name) {
+					t.Errorf("%s is in the metrics of %q", name, tt.engine)
+				}
+			}
+		})
+	}
+}
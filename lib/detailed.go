@@ -0,0 +1,107 @@
+package mpawselasticsearch
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// detailedStatistics are the statistics -detailed-stats fetches of a metric.
+var detailedStatistics = []string{metricsTypeAverage, metricsTypeMaximum, metricsTypeMinimum, metricsTypeSum}
+
+// latencyPercentileMetrics are the metrics -latency-percentiles fetches
+// percentiles of.
+var latencyPercentileMetrics = []string{"ReadLatency", "WriteLatency", "SearchLatency", "IndexingLatency"}
+
+// sampleCountStatistic is fetched of every metric with -with-sample-count.
+const sampleCountStatistic = "SampleCount"
+
+var percentileReg = regexp.MustCompile(`\Ap(100|[0-9]{1,2}(\.[0-9]+)?)\z`)
+
+// parsePercentiles parses a comma separated list of percentile statistics like p90,p99.
+func parsePercentiles(s string) ([]string, error) {
+	names := parseMetricNames(s)
+	for _, p := range names {
+		if !percentileReg.MatchString(p) {
+			return nil, fmt.Errorf("invalid percentile %q: expected e.g. p99 or p99.9", p)
+		}
+	}
+	return names, nil
+}
+
+// statisticSeries returns the metric fetched with another statistic and
+// posted as <prefix>.<key>. The key of the metric leads to no other key, as
+// the multi-domain wildcard graphs would match those as well.
+func statisticSeries(met metrics, stat, prefix string) metrics {
+	met.Type = stat
+	met.Key = prefix + "." + met.key()
+	return met
+}
+
+// extraSeries returns the series fetched in addition to mets, e.g.
+// average.CPUUtilization for -detailed-stats=CPUUtilization and
+// p99.ReadLatency for -latency-percentiles=p99.
+func (p ESPlugin) extraSeries(mets []metrics) []metrics {
+	var series []metrics
+	for _, met := range mets {
+		if slices.Contains(p.DetailedStats, met.Name) {
+			for _, stat := range detailedStatistics {
+				series = append(series, statisticSeries(met, stat, strings.ToLower(stat)))
+			}
+		}
+		if slices.Contains(latencyPercentileMetrics, met.Name) {
+			for _, pct := range p.Percentiles {
+				series = append(series, statisticSeries(met, pct, sanitizeKey(pct)))
+			}
+		}
+		if p.WithSampleCount {
+			series = append(series, statisticSeries(met, sampleCountStatistic, "samplecount"))
+		}
+	}
+	return series
+}
+
+// addExtraSeries draws the extraSeries of each metric in the graph of the
+// metric. The sample counts are drawn in a graph of their own instead.
+func (p ESPlugin) addExtraSeries(graphs map[string]mp.Graphs) {
+	series := make(map[string][]metrics)
+	for _, met := range p.metricList() {
+		series[met.key()] = p.extraSeries([]metrics{met})
+	}
+	for key, g := range graphs {
+		var added []mp.Metrics
+		for _, m := range g.Metrics {
+			// Extra statistics would pile onto a stack.
+			if m.Stacked {
+				continue
+			}
+			for _, s := range series[m.Name] {
+				if s.Type == sampleCountStatistic {
+					continue
+				}
+				added = append(added, mp.Metrics{Name: s.key(), Label: m.Label + " (" + s.Type + ")", Scale: m.Scale})
+			}
+		}
+		if len(added) > 0 {
+			g.Metrics = append(g.Metrics, added...)
+			graphs[key] = g
+		}
+	}
+}
+
+// sampleCountGraphDefinition draws the number of samples the datapoint of
+// each metric is based on.
+func (p ESPlugin) sampleCountGraphDefinition(labelPrefix string) mp.Graphs {
+	var mets []mp.Metrics
+	for _, met := range p.metricList() {
+		mets = append(mets, mp.Metrics{Name: "samplecount." + met.key(), Label: met.Name})
+	}
+	return mp.Graphs{
+		Label:   labelPrefix + " Sample Counts",
+		Unit:    "integer",
+		Metrics: mets,
+	}
+}
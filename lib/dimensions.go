@@ -0,0 +1,98 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// Dimension sets a domain may publish its metrics under. Some OpenSearch 2.x
+// domains publish without ClientId, and queries including it return nothing.
+const (
+	dimensionSetFull   = "DomainName,ClientId"
+	dimensionSetDomain = "DomainName"
+)
+
+// probeMetric is published by every domain and decides the dimension set.
+var probeMetric = metrics{Name: "Nodes", Type: metricsTypeAverage}
+
+func (p ESPlugin) dimensions() []*cloudwatch.Dimension {
+	name := "DomainName"
+	if p.Serverless {
+		name = "CollectionId"
+	}
+	dimensions := []*cloudwatch.Dimension{
+		{
+			Name:  aws.String(name),
+			Value: aws.String(p.Domain),
+		},
+	}
+	if p.Serverless && p.CollectionName != "" {
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String("CollectionName"),
+			Value: aws.String(p.CollectionName),
+		})
+	}
+	if p.DimensionSet != dimensionSetDomain {
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String("ClientId"),
+			Value: aws.String(p.ClientID),
+		})
+	}
+	return append(dimensions, p.ExtraDimensions...)
+}
+
+// dimensionString formats the dimensions of the domain as Name=Value pairs.
+func (p ESPlugin) dimensionString() string {
+	f := dimensionFlag(p.dimensions())
+	return f.String()
+}
+
+// dimensionFlag collects the repeatable -dimension Name=Value flag.
+type dimensionFlag []*cloudwatch.Dimension
+
+func (f *dimensionFlag) String() string {
+	var pairs []string
+	for _, d := range *f {
+		pairs = append(pairs, aws.StringValue(d.Name)+"="+aws.StringValue(d.Value))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f *dimensionFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" || value == "" {
+		return fmt.Errorf("expected Name=Value, got %q", s)
+	}
+	if name == "DomainName" || name == "CollectionId" || name == "ClientId" {
+		return fmt.Errorf("%s is set by the plugin", name)
+	}
+	*f = append(*f, &cloudwatch.Dimension{Name: aws.String(name), Value: aws.String(value)})
+	return nil
+}
+
+// resolveDimensionSet uses the dimension set cached in st, or probes the full
+// set and then DomainName only and caches the first one returning data.
+// When neither does, the full set is used and probing is retried next run.
+func (p *ESPlugin) resolveDimensionSet(ctx context.Context, st *pluginState) {
+	if st.DimensionSet != "" {
+		p.DimensionSet = st.DimensionSet
+		return
+	}
+	for _, set := range []string{dimensionSetFull, dimensionSetDomain} {
+		p.DimensionSet = set
+		points, err := p.getLastPointsFromCloudWatch(ctx, []metricQuery{{metric: probeMetric, dimensions: p.dimensions()}})
+		if err != nil {
+			errorf("%s: probe dimensions %s: %s", p.Domain, set, err)
+			break
+		}
+		if points[0] != nil {
+			st.DimensionSet = set
+			return
+		}
+	}
+	p.DimensionSet = dimensionSetFull
+}
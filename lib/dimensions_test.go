@@ -0,0 +1,103 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// answerDimensionSet answers the queries made with the dimension set with a
+// datapoint, and the others with none.
+func answerDimensionSet(set string) func(*cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+	return func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+		out := &cloudwatch.GetMetricDataOutput{}
+		for _, q := range in.MetricDataQueries {
+			var names []string
+			for _, d := range q.MetricStat.Metric.Dimensions {
+				names = append(names, aws.StringValue(d.Name))
+			}
+			r := &cloudwatch.MetricDataResult{Id: q.Id, StatusCode: aws.String(cloudwatch.StatusCodeComplete)}
+			if strings.Join(names, ",") == set {
+				r.Timestamps = []*time.Time{aws.Time(fakeTime)}
+				r.Values = []*float64{aws.Float64(1)}
+			}
+			out.MetricDataResults = append(out.MetricDataResults, r)
+		}
+		return []*cloudwatch.GetMetricDataOutput{out}, nil
+	}
+}
+
+func TestResolveDimensionSet(t *testing.T) {
+	tests := []struct {
+		name          string
+		cached        string
+		getMetricData func(*cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error)
+		want          string
+		wantCache     string
+		wantProbes    int
+		wantError     bool
+	}{
+		{
+			name:          "full set",
+			getMetricData: answerDimensionSet(dimensionSetFull),
+			want:          dimensionSetFull,
+			wantCache:     dimensionSetFull,
+			wantProbes:    1,
+		},
+		{
+			name:          "domain only",
+			getMetricData: answerDimensionSet(dimensionSetDomain),
+			want:          dimensionSetDomain,
+			wantCache:     dimensionSetDomain,
+			wantProbes:    2,
+		},
+		{
+			name:          "neither",
+			getMetricData: answerDimensionSet(""),
+			want:          dimensionSetFull,
+			wantProbes:    2,
+		},
+		{
+			name: "probe error",
+			getMetricData: func(*cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+				return nil, errors.New("throttled")
+			},
+			want:       dimensionSetFull,
+			wantProbes: 1,
+			wantError:  true,
+		},
+		{
+			name:          "cached",
+			cached:        dimensionSetDomain,
+			getMetricData: answerDimensionSet(dimensionSetFull),
+			want:          dimensionSetDomain,
+			wantCache:     dimensionSetDomain,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			cw := &fakeCloudWatch{getMetricData: tt.getMetricData}
+			p := &ESPlugin{Domain: "d", ClientID: "1", CloudWatch: cw, Period: 60, Lookback: 180}
+			st := pluginState{DimensionSet: tt.cached}
+			p.resolveDimensionSet(context.Background(), &st)
+			if p.DimensionSet != tt.want {
+				t.Errorf("DimensionSet = %q, want %q", p.DimensionSet, tt.want)
+			}
+			if st.DimensionSet != tt.wantCache {
+				t.Errorf("cached dimension set = %q, want %q", st.DimensionSet, tt.wantCache)
+			}
+			if n := len(cw.calls()); n != tt.wantProbes {
+				t.Errorf("%d probes, want %d", n, tt.wantProbes)
+			}
+			if logged := strings.Contains(logs.String(), "error: "); logged != tt.wantError {
+				t.Errorf("error logged = %v, want %v:\n%s", logged, tt.wantError, logs)
+			}
+		})
+	}
+}
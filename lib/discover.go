@@ -0,0 +1,183 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"maps"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// resolveMetricNames uses the metric names cached in st, or lists them and
+// caches them when they are older than DiscoveryInterval. When listing fails,
+// the next runs list again.
+func (p *ESPlugin) resolveMetricNames(ctx context.Context, st *pluginState) {
+	if st.DiscoveredAt != 0 && time.Since(time.Unix(st.DiscoveredAt, 0)) < p.DiscoveryInterval {
+		// A domain without metrics is cached as well.
+		p.metricNames = append([]string{}, st.MetricNames...)
+		return
+	}
+	names, err := p.listMetricNames(ctx)
+	if err != nil {
+		errorf("%s: discover metrics: %s", p.Domain, err)
+		return
+	}
+	st.MetricNames = names
+	st.DiscoveredAt = time.Now().Unix()
+	p.metricNames = append([]string{}, names...)
+}
+
+// discoveredMetricNames returns the cached metric names of the domain, or
+// lists them when there are none.
+func (p ESPlugin) discoveredMetricNames(ctx context.Context) ([]string, error) {
+	if p.metricNames != nil {
+		return p.metricNames, nil
+	}
+	return p.listMetricNames(ctx)
+}
+
+// listMetricNames returns the names of the metrics CloudWatch has for the
+// domain, including node level ones, sorted and without duplicates.
+func (p ESPlugin) listMetricNames(ctx context.Context) ([]string, error) {
+	var filters []*cloudwatch.DimensionFilter
+	for _, d := range p.dimensions() {
+		filters = append(filters, &cloudwatch.DimensionFilter{Name: d.Name, Value: d.Value})
+	}
+
+	var names []string
+	err := p.CloudWatch.ListMetricsPagesWithContext(ctx, &cloudwatch.ListMetricsInput{
+		Namespace:  aws.String(p.nameSpace()),
+		Dimensions: filters,
+	}, func(page *cloudwatch.ListMetricsOutput, lastPage bool) bool {
+		for _, m := range page.Metrics {
+			names = append(names, aws.StringValue(m.MetricName))
+		}
+		return true
+	})
+	slices.Sort(names)
+	return slices.Compact(names), err
+}
+
+// threadpoolMetricReg matches the threadpool metrics, e.g. ThreadpoolSearchQueue.
+var threadpoolMetricReg = regexp.MustCompile(`\AThreadpool([A-Za-z0-9_]+?)(Queue|Rejected|Threads)\z`)
+
+// threadpoolStatistics are the statistics the threadpool metrics are fetched with.
+var threadpoolStatistics = map[string]string{
+	"Queue":    metricsTypeMaximum,
+	"Rejected": metricsTypeMaximum,
+	"Threads":  metricsTypeAverage,
+}
+
+// discoverThreadpools returns the threadpool metrics the domain publishes,
+// keyed Threadpool.<pool>.<Queue|Rejected|Threads> for the Threadpool.# graph.
+func (p ESPlugin) discoverThreadpools(ctx context.Context) ([]metrics, error) {
+	names, err := p.discoveredMetricNames(ctx)
+	var mets []metrics
+	for _, name := range names {
+		m := threadpoolMetricReg.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		mets = append(mets, metrics{
+			Name: name,
+			Type: threadpoolStatistics[m[2]],
+			Key:  "Threadpool." + sanitizeKey(m[1]) + "." + m[2],
+		})
+	}
+	return mets, err
+}
+
+// fetchDiscoveredThreadpools adds the discovered threadpool metrics to stat.
+func (p ESPlugin) fetchDiscoveredThreadpools(ctx context.Context, stat map[string]float64) {
+	mets, err := p.discoverThreadpools(ctx)
+	if err != nil {
+		errorf("%s: discover threadpools: %s", p.Domain, err)
+	}
+	if len(mets) == 0 {
+		return
+	}
+	queries := make([]metricQuery, len(mets))
+	for i, met := range mets {
+		queries[i] = metricQuery{metric: met, dimensions: p.dimensions()}
+	}
+	points, err := p.getLastPointsFromCloudWatch(ctx, queries)
+	if err != nil {
+		errorf("%s: threadpool metrics: %s", p.Domain, err)
+	}
+	for i, met := range mets {
+		stat = mergeStatFromDatapoint(stat, points[i], met)
+	}
+}
+
+// discoverMetrics restricts mets to the built-in metrics CloudWatch has for
+// the domain and adds those it has that the plugin does not know, fetched
+// with Average as Discovered.<name>.value. When listing fails, mets is
+// fetched as it is.
+func (p ESPlugin) discoverMetrics(ctx context.Context, mets []metrics) []metrics {
+	names, err := p.discoveredMetricNames(ctx)
+	if err != nil {
+		errorf("%s: discover metrics: %s", p.Domain, err)
+		return mets
+	}
+	published := make(map[string]bool, len(names))
+	for _, name := range names {
+		published[name] = true
+	}
+	builtin := make(map[string]bool)
+	for _, met := range p.builtinMetrics() {
+		builtin[met.Name] = true
+	}
+	known := maps.Clone(builtin)
+	if p.metricDefs != nil {
+		for _, def := range p.metricDefs.Metrics {
+			known[def.Name] = true
+		}
+	}
+
+	discovered := slices.DeleteFunc(mets, func(met metrics) bool {
+		// Account level metrics are not listed under the collection.
+		return builtin[met.Name] && !published[met.Name] && !slices.Contains(accountLevelServerlessMetrics, met.Name)
+	})
+	for _, name := range names {
+		if known[name] || !p.selected(name) {
+			continue
+		}
+		if p.DiscoverThreadpools && threadpoolMetricReg.MatchString(name) {
+			continue
+		}
+		discovered = append(discovered, metrics{
+			Name: name,
+			Type: metricsTypeAverage,
+			Key:  "Discovered." + sanitizeKey(name) + ".value",
+		})
+	}
+	return discovered
+}
+
+// discoveredGraphDefinition draws each metric discovered by -discover in a
+// graph of its own.
+func discoveredGraphDefinition(labelPrefix string) mp.Graphs {
+	return mp.Graphs{
+		Label: labelPrefix + " Discovered",
+		Unit:  "float",
+		Metrics: []mp.Metrics{
+			{Name: "value", Label: "Value"},
+		},
+	}
+}
+
+func threadpoolGraphDefinition(labelPrefix string) mp.Graphs {
+	return mp.Graphs{
+		Label: labelPrefix + " Threadpool",
+		Unit:  "integer",
+		Metrics: []mp.Metrics{
+			{Name: "Queue", Label: "Queue"},
+			{Name: "Rejected", Label: "Rejected"},
+			{Name: "Threads", Label: "Threads"},
+		},
+	}
+}
@@ -0,0 +1,63 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func listing(names ...string) func(*cloudwatch.ListMetricsInput) ([]*cloudwatch.ListMetricsOutput, error) {
+	return func(in *cloudwatch.ListMetricsInput) ([]*cloudwatch.ListMetricsOutput, error) {
+		out := &cloudwatch.ListMetricsOutput{}
+		for _, name := range names {
+			out.Metrics = append(out.Metrics, &cloudwatch.Metric{Namespace: in.Namespace, MetricName: aws.String(name)})
+		}
+		return []*cloudwatch.ListMetricsOutput{out}, nil
+	}
+}
+
+func TestResolveStateCachesMetricNames(t *testing.T) {
+	for _, serverless := range []bool{false, true} {
+		name := "domain"
+		if serverless {
+			name = "serverless"
+		}
+		t.Run(name, func(t *testing.T) {
+			tempfile := filepath.Join(t.TempDir(), "tmp")
+			cw := &fakeCloudWatch{
+				getMetricData: answerByName(map[string]float64{"Nodes": 3}),
+				listMetrics:   listing("SearchOCU", "Nodes"),
+			}
+			var firstRun int
+			for run := range 3 {
+				p := ESPlugin{
+					Domain:            "d",
+					CloudWatch:        cw,
+					Engine:            engineElasticsearch,
+					Serverless:        serverless,
+					Discover:          true,
+					DiscoveryInterval: time.Hour,
+					Period:            60,
+					Lookback:          180,
+				}
+				if serverless {
+					p.Engine = ""
+				}
+				p.resolveState(context.Background(), tempfile, "key")
+				if got, want := p.metricNames, []string{"Nodes", "SearchOCU"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+					t.Fatalf("run %d: metricNames = %v, want %v", run, got, want)
+				}
+				if run == 0 {
+					firstRun = cw.listMetricsCalled
+				}
+			}
+			if cw.listMetricsCalled != firstRun {
+				t.Errorf("ListMetrics called %d times after the first run, want none", cw.listMetricsCalled-firstRun)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package mpawselasticsearch
+
+import (
+	"bytes"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/opensearchservice"
+	"github.com/aws/aws-sdk-go/service/opensearchservice/opensearchserviceiface"
+)
+
+// fakeCloudWatch answers the CloudWatch calls of the plugin from funcs and
+// records their inputs. Calls it does not override panic.
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+
+	// getMetricData returns the pages of a GetMetricData call. When nil,
+	// every query gets one datapoint valued by its index, see answerQueries.
+	getMetricData func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error)
+	listMetrics   func(in *cloudwatch.ListMetricsInput) ([]*cloudwatch.ListMetricsOutput, error)
+	// stuck makes every call block until its context is done.
+	stuck bool
+
+	mu                sync.Mutex
+	getMetricDataIns  []*cloudwatch.GetMetricDataInput
+	listMetricsCalled int
+}
+
+func (f *fakeCloudWatch) GetMetricDataPagesWithContext(ctx aws.Context, in *cloudwatch.GetMetricDataInput, fn func(*cloudwatch.GetMetricDataOutput, bool) bool, _ ...request.Option) error {
+	f.mu.Lock()
+	f.getMetricDataIns = append(f.getMetricDataIns, in)
+	f.mu.Unlock()
+	if f.stuck {
+		<-ctx.Done()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	get := f.getMetricData
+	if get == nil {
+		get = answerQueries
+	}
+	pages, err := get(in)
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return err
+}
+
+func (f *fakeCloudWatch) GetMetricDataWithContext(ctx aws.Context, in *cloudwatch.GetMetricDataInput, opts ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	out := &cloudwatch.GetMetricDataOutput{}
+	err := f.GetMetricDataPagesWithContext(ctx, in, func(page *cloudwatch.GetMetricDataOutput, lastPage bool) bool {
+		out.MetricDataResults = append(out.MetricDataResults, page.MetricDataResults...)
+		return true
+	}, opts...)
+	return out, err
+}
+
+func (f *fakeCloudWatch) ListMetricsPagesWithContext(ctx aws.Context, in *cloudwatch.ListMetricsInput, fn func(*cloudwatch.ListMetricsOutput, bool) bool, _ ...request.Option) error {
+	f.mu.Lock()
+	f.listMetricsCalled++
+	f.mu.Unlock()
+	if f.stuck {
+		<-ctx.Done()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if f.listMetrics == nil {
+		return nil
+	}
+	pages, err := f.listMetrics(in)
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return err
+}
+
+// fakeOpenSearch answers DescribeDomain from describeDomain and counts the
+// calls. Calls it does not override panic.
+type fakeOpenSearch struct {
+	opensearchserviceiface.OpenSearchServiceAPI
+
+	describeDomain func(in *opensearchservice.DescribeDomainInput) (*opensearchservice.DescribeDomainOutput, error)
+	// stuck makes every call block until its context is done.
+	stuck bool
+
+	mu                   sync.Mutex
+	describeDomainCalled int
+}
+
+func (f *fakeOpenSearch) DescribeDomainWithContext(ctx aws.Context, in *opensearchservice.DescribeDomainInput, _ ...request.Option) (*opensearchservice.DescribeDomainOutput, error) {
+	f.mu.Lock()
+	f.describeDomainCalled++
+	f.mu.Unlock()
+	if f.stuck {
+		<-ctx.Done()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return f.describeDomain(in)
+}
+
+// describeVersion answers DescribeDomain with a domain of the engine version.
+func describeVersion(version string) func(*opensearchservice.DescribeDomainInput) (*opensearchservice.DescribeDomainOutput, error) {
+	return func(in *opensearchservice.DescribeDomainInput) (*opensearchservice.DescribeDomainOutput, error) {
+		return &opensearchservice.DescribeDomainOutput{
+			DomainStatus: &opensearchservice.DomainStatus{
+				DomainName:    in.DomainName,
+				EngineVersion: aws.String(version),
+			},
+		}, nil
+	}
+}
+
+// calls returns the inputs of the GetMetricData calls made so far.
+func (f *fakeCloudWatch) calls() []*cloudwatch.GetMetricDataInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*cloudwatch.GetMetricDataInput{}, f.getMetricDataIns...)
+}
+
+// fakeTime is the timestamp of the datapoints answerQueries returns.
+var fakeTime = time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC)
+
+// answerQueries answers every query m<i> with a single datapoint of value i.
+func answerQueries(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+	out := &cloudwatch.GetMetricDataOutput{}
+	for _, q := range in.MetricDataQueries {
+		i, _ := strconv.Atoi(strings.TrimPrefix(aws.StringValue(q.Id), "m"))
+		out.MetricDataResults = append(out.MetricDataResults, &cloudwatch.MetricDataResult{
+			Id:         q.Id,
+			StatusCode: aws.String(cloudwatch.StatusCodeComplete),
+			Timestamps: []*time.Time{aws.Time(fakeTime)},
+			Values:     []*float64{aws.Float64(float64(i))},
+		})
+	}
+	return []*cloudwatch.GetMetricDataOutput{out}, nil
+}
+
+// answerByName answers the queries of the metrics in values with a single
+// datapoint of their value, and the others with none.
+func answerByName(values map[string]float64) func(*cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+	return func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+		out := &cloudwatch.GetMetricDataOutput{}
+		for _, q := range in.MetricDataQueries {
+			r := &cloudwatch.MetricDataResult{Id: q.Id, StatusCode: aws.String(cloudwatch.StatusCodeComplete)}
+			if q.MetricStat != nil {
+				if v, ok := values[aws.StringValue(q.MetricStat.Metric.MetricName)]; ok {
+					r.Timestamps = []*time.Time{aws.Time(fakeTime)}
+					r.Values = []*float64{aws.Float64(v)}
+				}
+			}
+			out.MetricDataResults = append(out.MetricDataResults, r)
+		}
+		return []*cloudwatch.GetMetricDataOutput{out}, nil
+	}
+}
+
+// captureLog returns the buffer the standard logger writes to until the end
+// of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	out, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
@@ -0,0 +1,232 @@
+package mpawselasticsearch
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Components of DomainHealthScore.
+const (
+	healthStatus   = "status"
+	healthJVM      = "jvm"
+	healthStorage  = "storage"
+	healthWrites   = "writes"
+	healthSnapshot = "snapshot"
+)
+
+var defaultHealthWeights = map[string]float64{
+	healthStatus:   40,
+	healthJVM:      20,
+	healthStorage:  20,
+	healthWrites:   10,
+	healthSnapshot: 10,
+}
+
+// healthyFreeStoragePercent is the free storage ratio at and above which
+// the storage component scores fully.
+const healthyFreeStoragePercent = 25
+
+func parseHealthWeights(s string) (map[string]float64, error) {
+	weights := make(map[string]float64, len(defaultHealthWeights))
+	for k, v := range defaultHealthWeights {
+		weights[k] = v
+	}
+	if s == "" {
+		return weights, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid health weight %q: expected component=weight", pair)
+		}
+		if _, ok := defaultHealthWeights[name]; !ok {
+			return nil, fmt.Errorf("unknown health component %q", name)
+		}
+		w, err := strconv.ParseFloat(value, 64)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight %q for %s", value, name)
+		}
+		weights[name] = w
+	}
+	return weights, nil
+}
+
+func clamp01(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
+
+// healthComponents scores each component between 0 (bad) and 1 (healthy)
+// from the fetched metrics. Components whose inputs are missing are omitted.
+func healthComponents(stat map[string]float64) map[string]float64 {
+	scores := make(map[string]float64)
+
+	red, hasRed := stat["ClusterStatus.red"]
+	yellow, hasYellow := stat["ClusterStatus.yellow"]
+	green, hasGreen := stat["ClusterStatus.green"]
+	switch {
+	case hasRed && red >= 1:
+		scores[healthStatus] = 0
+	case hasYellow && yellow >= 1:
+		scores[healthStatus] = 0.5
+	case hasGreen && green >= 1:
+		scores[healthStatus] = 1
+	}
+
+	if v, ok := stat["JVMMemoryPressure"]; ok {
+		scores[healthJVM] = clamp01(1 - v/100)
+	}
+
+	if v, ok := freeStorageSpacePercent(stat); ok {
+		scores[healthStorage] = clamp01(v / healthyFreeStoragePercent)
+	}
+
+	if v, ok := stat["ClusterIndexWritesBlocked"]; ok {
+		scores[healthWrites] = boolScore(v < 1)
+	}
+	if v, ok := stat["AutomatedSnapshotFailure"]; ok {
+		scores[healthSnapshot] = boolScore(v < 1)
+	}
+	return scores
+}
+
+// freeStorageSumSeries returns the Sum of FreeStorageSpace over the nodes,
+// the free space of the whole cluster, unless mets already fetch it. The
+// Minimum FreeStorageSpace is fetched with is the free space of the fullest
+// node only.
+func freeStorageSumSeries(mets []metrics) (metrics, bool) {
+	return extraStatisticSeries(mets, "FreeStorageSpace", metricsTypeSum)
+}
+
+// extraStatisticSeries returns the named metric of mets fetched with another
+// statistic, posted as <statistic>.<key>, unless mets already fetch it.
+func extraStatisticSeries(mets []metrics, name, stat string) (metrics, bool) {
+	i := slices.IndexFunc(mets, func(met metrics) bool { return met.Name == name && met.Key == "" })
+	if i < 0 {
+		return metrics{}, false
+	}
+	series := statisticSeries(mets[i], stat, strings.ToLower(stat))
+	if slices.ContainsFunc(mets, func(met metrics) bool { return met.key() == series.key() }) {
+		return metrics{}, false
+	}
+	return series, true
+}
+
+// freeStorageSpacePercent is the free share of the storage, from the native
+// utilization metrics when the domain publishes them and otherwise computed
+// from the Sum of FreeStorageSpace over the nodes and ClusterUsedSpace.
+func freeStorageSpacePercent(stat map[string]float64) (float64, bool) {
+	for _, name := range []string{"StorageUtilization", "HotStorageSpaceUtilization"} {
+		if v, ok := stat[name]; ok {
+			return 100 - v, true
+		}
+	}
+	free, hasFree := stat["sum.FreeStorageSpace"]
+	used, hasUsed := stat["ClusterUsedSpace"]
+	if hasFree && hasUsed && free+used > 0 {
+		return free / (free + used) * 100, true
+	}
+	return 0, false
+}
+
+// worstNodeFreeStoragePercent is the free share of the fullest node. The
+// Minimum of FreeStorageSpace is the free space of that node, and every node
+// has a volume of volumeSize GiB.
+func worstNodeFreeStoragePercent(stat map[string]float64, volumeSize int64) (float64, bool) {
+	free, ok := stat["FreeStorageSpace"]
+	if !ok || volumeSize <= 0 {
+		return 0, false
+	}
+	return free / (float64(volumeSize) * 1024 * 1024 * 1024) * 100, true
+}
+
+// fetchedStatus reports whether the run fetched the status of the domain,
+// i.e. whether monitoring works. When no ClusterStatus metric is fetched at
+// all, as for collections or with -include-metrics, any metric counts.
+func (p ESPlugin) fetchedStatus(stat map[string]float64) bool {
+	queried := false
+	for _, met := range p.metricList() {
+		if !strings.HasPrefix(met.Name, "ClusterStatus.") {
+			continue
+		}
+		queried = true
+		if _, ok := stat[met.key()]; ok {
+			return true
+		}
+	}
+	return !queried && len(stat) > 0
+}
+
+func boolScore(healthy bool) float64 {
+	if healthy {
+		return 1
+	}
+	return 0
+}
+
+// domainHealthScore is the weighted mean of the available components scaled
+// to 0-100. The weights of missing components are left out, so the remaining
+// ones are renormalized. It reports false when nothing could be scored.
+func domainHealthScore(stat map[string]float64, weights map[string]float64) (float64, bool) {
+	var sum, total float64
+	for name, score := range healthComponents(stat) {
+		sum += weights[name] * score
+		total += weights[name]
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return sum / total * 100, true
+}
+
+// nodesMinimumSeries returns the Minimum of Nodes NodesMissing is computed
+// from, unless mets already fetch it. A node dropping out for part of the
+// period lowers the minimum but hardly the average.
+func (p ESPlugin) nodesMinimumSeries(mets []metrics) (metrics, bool) {
+	if p.ExpectedNodes <= 0 {
+		return metrics{}, false
+	}
+	return extraStatisticSeries(mets, "Nodes", metricsTypeMinimum)
+}
+
+// nodesMissing is how many nodes fewer than expected the domain had at the
+// least in the period, 0 when it has as many or more, e.g. during a
+// blue/green deployment.
+func nodesMissing(stat map[string]float64, expected int64) (float64, bool) {
+	nodes, ok := stat["minimum.Nodes"]
+	if !ok || expected <= 0 {
+		return 0, false
+	}
+	return max(float64(expected)-nodes, 0), true
+}
+
+// sumOf adds up the named metrics, only when all of them were fetched.
+func sumOf(stat map[string]float64, names ...string) (float64, bool) {
+	var sum float64
+	for _, name := range names {
+		v, ok := stat[name]
+		if !ok {
+			return 0, false
+		}
+		sum += v
+	}
+	return sum, true
+}
+
+// percentOf is the named metric in percent of the total one, only when both
+// were fetched and the total is not 0.
+func percentOf(stat map[string]float64, name, total string) (float64, bool) {
+	v, ok := stat[name]
+	t, tok := stat[total]
+	if !ok || !tok || t == 0 {
+		return 0, false
+	}
+	return v / t * 100, true
+}
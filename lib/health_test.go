@@ -0,0 +1,353 @@
+package mpawselasticsearch
+
+import (
+	"maps"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func TestFetchedStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		p    ESPlugin
+		stat map[string]float64
+		want bool
+	}{
+		{
+			name: "status fetched",
+			p:    ESPlugin{},
+			stat: map[string]float64{"ClusterStatus.green": 1, "Nodes": 3},
+			want: true,
+		},
+		{
+			name: "status not fetched",
+			p:    ESPlugin{},
+			stat: map[string]float64{"Nodes": 3},
+			want: false,
+		},
+		{
+			name: "nothing fetched",
+			p:    ESPlugin{},
+			stat: map[string]float64{},
+			want: false,
+		},
+		{
+			name: "status not included",
+			p:    ESPlugin{IncludeMetrics: []string{"FreeStorageSpace"}},
+			stat: map[string]float64{"FreeStorageSpace": 1024},
+			want: true,
+		},
+		{
+			name: "status partly excluded",
+			p:    ESPlugin{ExcludeMetrics: []string{"ClusterStatus.green", "ClusterStatus.yellow"}},
+			stat: map[string]float64{"FreeStorageSpace": 1024},
+			want: false,
+		},
+		{
+			name: "status excluded",
+			p:    ESPlugin{ExcludeMetrics: []string{"ClusterStatus.green", "ClusterStatus.yellow", "ClusterStatus.red"}},
+			stat: map[string]float64{"FreeStorageSpace": 1024},
+			want: true,
+		},
+		{
+			name: "status replaced by file",
+			p: ESPlugin{metricDefs: &metricDefinitionFile{
+				Replace: true,
+				Metrics: []metricDefinition{{Name: "Custom", Statistic: metricsTypeAverage}},
+			}},
+			stat: map[string]float64{"Custom": 1},
+			want: true,
+		},
+		{
+			name: "serverless",
+			p:    ESPlugin{Serverless: true},
+			stat: map[string]float64{"SearchOCU": 2},
+			want: true,
+		},
+		{
+			name: "serverless nothing fetched",
+			p:    ESPlugin{Serverless: true},
+			stat: map[string]float64{},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.fetchedStatus(tt.stat); got != tt.want {
+				t.Errorf("fetchedStatus(%v) = %v, want %v", tt.stat, got, tt.want)
+			}
+		})
+	}
+}
+
+// answerNodes answers Nodes with a datapoint of the statistic queried, the
+// others with none.
+func answerNodes(values map[string]float64) func(*cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+	return func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+		out := &cloudwatch.GetMetricDataOutput{}
+		for _, q := range in.MetricDataQueries {
+			r := &cloudwatch.MetricDataResult{Id: q.Id, StatusCode: aws.String(cloudwatch.StatusCodeComplete)}
+			if q.MetricStat != nil && aws.StringValue(q.MetricStat.Metric.MetricName) == "Nodes" {
+				r.Timestamps = []*time.Time{aws.Time(fakeTime)}
+				r.Values = []*float64{aws.Float64(values[aws.StringValue(q.MetricStat.Stat)])}
+			}
+			out.MetricDataResults = append(out.MetricDataResults, r)
+		}
+		return []*cloudwatch.GetMetricDataOutput{out}, nil
+	}
+}
+
+func TestNodesMissing(t *testing.T) {
+	tests := []struct {
+		name          string
+		expected      int64
+		detailedStats []string
+		want          float64
+		wantFetched   bool
+		wantQueries   int
+	}{
+		{name: "disabled", wantQueries: 0},
+		// One of three nodes dropped out for a sixth of the period.
+		{name: "expected", expected: 3, want: 1, wantFetched: true, wantQueries: 1},
+		{name: "detailed stats", expected: 3, detailedStats: []string{"Nodes"}, want: 1, wantFetched: true, wantQueries: 1},
+		{name: "more than expected", expected: 1, want: 0, wantFetched: true, wantQueries: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cw := &fakeCloudWatch{getMetricData: answerNodes(map[string]float64{
+				metricsTypeAverage: 2 + 5.0/6,
+				metricsTypeMinimum: 2,
+				metricsTypeMaximum: 3,
+				metricsTypeSum:     17,
+			})}
+			p := ESPlugin{
+				Domain:        "d",
+				CloudWatch:    cw,
+				Engine:        engineElasticsearch,
+				Period:        60,
+				Lookback:      180,
+				ExpectedNodes: tt.expected,
+				DetailedStats: tt.detailedStats,
+			}
+			stat, err := p.FetchMetrics()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := stat["NodesMissing"]
+			if ok != tt.wantFetched || got != tt.want {
+				t.Errorf("NodesMissing = %g (%v), want %g (%v)", got, ok, tt.want, tt.wantFetched)
+			}
+			var queries int
+			for _, in := range cw.calls() {
+				for _, q := range in.MetricDataQueries {
+					if aws.StringValue(q.MetricStat.Metric.MetricName) == "Nodes" && aws.StringValue(q.MetricStat.Stat) == metricsTypeMinimum {
+						queries++
+					}
+				}
+			}
+			if queries != tt.wantQueries {
+				t.Errorf("the Minimum of Nodes is queried %d times, want %d", queries, tt.wantQueries)
+			}
+		})
+	}
+}
+
+func TestFreeStorageSpacePercent(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+	tests := []struct {
+		name   string
+		stat   map[string]float64
+		want   float64
+		wantOK bool
+	}{
+		{
+			name:   "single node",
+			stat:   map[string]float64{"FreeStorageSpace": 25 * gib, "sum.FreeStorageSpace": 25 * gib, "ClusterUsedSpace": 75 * gib},
+			want:   25,
+			wantOK: true,
+		},
+		{
+			// Three nodes of 100 GiB, each half used: the Minimum is one node's
+			// 50 GiB, the Sum the cluster's 150 GiB.
+			name:   "three nodes",
+			stat:   map[string]float64{"FreeStorageSpace": 50 * gib, "sum.FreeStorageSpace": 150 * gib, "ClusterUsedSpace": 150 * gib},
+			want:   50,
+			wantOK: true,
+		},
+		{
+			name:   "uneven nodes",
+			stat:   map[string]float64{"FreeStorageSpace": 10 * gib, "sum.FreeStorageSpace": 90 * gib, "ClusterUsedSpace": 210 * gib},
+			want:   30,
+			wantOK: true,
+		},
+		{
+			name:   "native utilization",
+			stat:   map[string]float64{"StorageUtilization": 60, "sum.FreeStorageSpace": 150 * gib, "ClusterUsedSpace": 150 * gib},
+			want:   40,
+			wantOK: true,
+		},
+		{
+			name: "minimum only",
+			stat: map[string]float64{"FreeStorageSpace": 50 * gib, "ClusterUsedSpace": 150 * gib},
+		},
+		{
+			name: "empty",
+			stat: map[string]float64{"sum.FreeStorageSpace": 0, "ClusterUsedSpace": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := freeStorageSpacePercent(tt.stat)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("freeStorageSpacePercent() = %g (%v), want %g (%v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFetchMetricsFreeStorageSpacePercent(t *testing.T) {
+	// A cluster of three nodes of 100 GiB, half used. FreeStorageSpace and
+	// ClusterUsedSpace are in MB on CloudWatch.
+	cw := &fakeCloudWatch{getMetricData: func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+		values := map[string]float64{
+			"FreeStorageSpace/" + metricsTypeMinimum: 50 * 1024,
+			"FreeStorageSpace/" + metricsTypeSum:     150 * 1024,
+			"ClusterUsedSpace/" + metricsTypeMinimum: 150 * 1024,
+		}
+		out := &cloudwatch.GetMetricDataOutput{}
+		for _, q := range in.MetricDataQueries {
+			r := &cloudwatch.MetricDataResult{Id: q.Id, StatusCode: aws.String(cloudwatch.StatusCodeComplete)}
+			if v, ok := values[aws.StringValue(q.MetricStat.Metric.MetricName)+"/"+aws.StringValue(q.MetricStat.Stat)]; ok {
+				r.Timestamps = []*time.Time{aws.Time(fakeTime)}
+				r.Values = []*float64{aws.Float64(v)}
+			}
+			out.MetricDataResults = append(out.MetricDataResults, r)
+		}
+		return []*cloudwatch.GetMetricDataOutput{out}, nil
+	}}
+	p := ESPlugin{Domain: "d", CloudWatch: cw, Engine: engineElasticsearch, Period: 60, Lookback: 180}
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stat["FreeStorageSpacePercent"]; got != 50 {
+		t.Errorf("FreeStorageSpacePercent = %g, want 50", got)
+	}
+	if got, want := stat["FreeStorageSpace"], float64(50*1024*1024*1024); got != want {
+		t.Errorf("FreeStorageSpace = %g, want the fullest node's %g", got, want)
+	}
+}
+
+func TestHealthComponents(t *testing.T) {
+	tests := []struct {
+		name string
+		stat map[string]float64
+		want map[string]float64
+	}{
+		{
+			name: "healthy",
+			stat: map[string]float64{
+				"ClusterStatus.green":       1,
+				"ClusterStatus.yellow":      0,
+				"ClusterStatus.red":         0,
+				"JVMMemoryPressure":         40,
+				"sum.FreeStorageSpace":      150,
+				"ClusterUsedSpace":          150,
+				"ClusterIndexWritesBlocked": 0,
+				"AutomatedSnapshotFailure":  0,
+			},
+			want: map[string]float64{healthStatus: 1, healthJVM: 0.6, healthStorage: 1, healthWrites: 1, healthSnapshot: 1},
+		},
+		{
+			name: "unhealthy",
+			stat: map[string]float64{
+				"ClusterStatus.green":       0,
+				"ClusterStatus.yellow":      1,
+				"ClusterStatus.red":         0,
+				"JVMMemoryPressure":         100,
+				"sum.FreeStorageSpace":      10,
+				"ClusterUsedSpace":          90,
+				"ClusterIndexWritesBlocked": 1,
+				"AutomatedSnapshotFailure":  2,
+			},
+			want: map[string]float64{healthStatus: 0.5, healthJVM: 0, healthStorage: 0.4, healthWrites: 0, healthSnapshot: 0},
+		},
+		{
+			name: "red",
+			stat: map[string]float64{"ClusterStatus.green": 0, "ClusterStatus.yellow": 1, "ClusterStatus.red": 1},
+			want: map[string]float64{healthStatus: 0},
+		},
+		{
+			name: "missing",
+			stat: map[string]float64{"JVMMemoryPressure": 25},
+			want: map[string]float64{healthJVM: 0.75},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := healthComponents(tt.stat)
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("healthComponents() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDomainHealthScore(t *testing.T) {
+	weights := map[string]float64{healthStatus: 40, healthJVM: 20, healthStorage: 20, healthWrites: 10, healthSnapshot: 10}
+	tests := []struct {
+		name    string
+		stat    map[string]float64
+		weights map[string]float64
+		want    float64
+		wantOK  bool
+	}{
+		{
+			// (40*0.5 + 20*0.6 + 20*0.4 + 10*1 + 10*0) / 100
+			name: "weighted",
+			stat: map[string]float64{
+				"ClusterStatus.yellow":      1,
+				"JVMMemoryPressure":         40,
+				"sum.FreeStorageSpace":      10,
+				"ClusterUsedSpace":          90,
+				"ClusterIndexWritesBlocked": 0,
+				"AutomatedSnapshotFailure":  1,
+			},
+			weights: weights,
+			want:    50,
+			wantOK:  true,
+		},
+		{
+			// Only status and jvm are scored: (40*1 + 20*0.4) / 60.
+			name:    "renormalized",
+			stat:    map[string]float64{"ClusterStatus.green": 1, "JVMMemoryPressure": 60},
+			weights: weights,
+			want:    80,
+			wantOK:  true,
+		},
+		{
+			name:    "zero weight",
+			stat:    map[string]float64{"ClusterStatus.green": 1, "AutomatedSnapshotFailure": 1},
+			weights: map[string]float64{healthStatus: 40, healthSnapshot: 0},
+			want:    100,
+			wantOK:  true,
+		},
+		{
+			name:    "nothing scored",
+			stat:    map[string]float64{"CPUUtilization": 50},
+			weights: weights,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := domainHealthScore(tt.stat, tt.weights)
+			if ok != tt.wantOK || math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("domainHealthScore() = %g (%v), want %g (%v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+//go:build integration
+
+package mpawselasticsearch
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// The integration tests run against localstack, at LOCALSTACK_ENDPOINT or
+// http://localhost:4566:
+//
+//	go test -tags integration ./...
+
+func localstackEndpoint() string {
+	if e := os.Getenv("LOCALSTACK_ENDPOINT"); e != "" {
+		return e
+	}
+	return "http://localhost:4566"
+}
+
+// newLocalstackPlugin returns a plugin of a domain of its own, so that the
+// datapoints of earlier runs are not fetched.
+func newLocalstackPlugin(t *testing.T) *ESPlugin {
+	t.Helper()
+	p := &ESPlugin{
+		Region:          "us-east-1",
+		AccessKeyID:     "test",
+		SecretAccessKey: "test",
+		Endpoint:        localstackEndpoint(),
+		Domain:          fmt.Sprintf("integration-%d", time.Now().UnixNano()),
+		ClientID:        "000000000000",
+		Engine:          engineElasticsearch,
+		Period:          60,
+		Lookback:        600,
+		Concurrency:     defaultConcurrency,
+		Timeout:         defaultTimeout,
+		MaxRetries:      defaultMaxRetries,
+	}
+	if err := p.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// putMetric seeds a datapoint of the metric of the domain of p.
+func putMetric(t *testing.T, p *ESPlugin, name string, ts time.Time, value float64) {
+	t.Helper()
+	_, err := p.CloudWatch.PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace: aws.String(p.nameSpace()),
+		MetricData: []*cloudwatch.MetricDatum{
+			{
+				MetricName: aws.String(name),
+				Dimensions: p.dimensions(),
+				Timestamp:  aws.Time(ts),
+				Value:      aws.Float64(value),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to put %s: %s", name, err)
+	}
+}
+
+func TestFetchMetricsLocalstack(t *testing.T) {
+	p := newLocalstackPlugin(t)
+
+	now := time.Now().Truncate(time.Minute)
+	older, latest := now.Add(-3*time.Minute), now.Add(-time.Minute)
+	putMetric(t, p, "CPUUtilization", older, 80)
+	putMetric(t, p, "CPUUtilization", latest, 25)
+	putMetric(t, p, "FreeStorageSpace", older, 100)
+	putMetric(t, p, "FreeStorageSpace", latest, 2)
+	putMetric(t, p, "Nodes", latest, 3)
+
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		// The latest datapoint is picked, not the largest nor the first.
+		"CPUUtilization": 25,
+		// FreeStorageSpace is in MB on CloudWatch.
+		"FreeStorageSpace": 2 * 1024 * 1024,
+		"Nodes":            3,
+	}
+	for key, v := range want {
+		got, ok := stat[key]
+		if !ok {
+			t.Errorf("%s is not fetched", key)
+			continue
+		}
+		if got != v {
+			t.Errorf("%s = %g, want %g", key, got, v)
+		}
+	}
+	if _, ok := stat["JVMMemoryPressure"]; ok {
+		t.Errorf("JVMMemoryPressure is fetched without datapoints: %g", stat["JVMMemoryPressure"])
+	}
+}
@@ -0,0 +1,57 @@
+package mpawselasticsearch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// jsonValue is a value printed by -json. Values computed by the plugin, like
+// DomainHealthScore, have neither a statistic nor a timestamp.
+type jsonValue struct {
+	Value     float64    `json:"value"`
+	Statistic string     `json:"statistic,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+}
+
+// writeJSON fetches the metrics of the domains and writes them as indented
+// JSON keyed by domain and metric key, for inspecting them with jq. It fails
+// only when no domain could be fetched.
+func writeJSON(w io.Writer, domains []ESPlugin) error {
+	out := make(map[string]map[string]jsonValue)
+	var errs []error
+	ctx, cancel := domains[0].runContext()
+	defer cancel()
+	for _, d := range domains {
+		stat, fetched, err := d.fetchMetrics(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.Domain, err))
+			continue
+		}
+		values := make(map[string]jsonValue, len(stat))
+		for k, v := range stat {
+			jv := jsonValue{Value: v}
+			if f, ok := fetched[k]; ok {
+				jv.Statistic = f.Statistic
+				jv.Timestamp = &f.Timestamp
+			}
+			values[k] = jv
+		}
+		out[d.Domain] = values
+	}
+	if len(errs) == len(domains) {
+		return errors.Join(errs...)
+	}
+	for _, err := range errs {
+		errorf("%s", err)
+	}
+
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
@@ -0,0 +1,63 @@
+package mpawselasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// failingDomain is a domain every GetMetricData call fails for.
+func failingDomain(name string) ESPlugin {
+	cw := &fakeCloudWatch{
+		getMetricData: func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+			return nil, errors.New("access denied")
+		},
+	}
+	return ESPlugin{Domain: name, CloudWatch: cw, Engine: engineElasticsearch, Period: 60, Lookback: 180}
+}
+
+func TestFetchMetricsNothingFetched(t *testing.T) {
+	stat, err := failingDomain("d").FetchMetrics()
+	if err != nil {
+		t.Errorf("FetchMetrics() error = %v, want nil so that Health is posted", err)
+	}
+	if len(stat) != 1 || stat["Health"] != 0 {
+		t.Errorf("FetchMetrics() = %v, want only Health 0", stat)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	ok := ESPlugin{Domain: "ok", CloudWatch: &fakeCloudWatch{}, Engine: engineElasticsearch, Period: 60, Lookback: 180}
+
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, []ESPlugin{failingDomain("failed"), ok}); err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]map[string]jsonValue
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := out["failed"]; found {
+		t.Errorf("writeJSON() printed the failed domain: %v", out["failed"])
+	}
+	if v := out["ok"]["Health"]; v.Value != 1 {
+		t.Errorf("Health of ok = %v, want 1", v)
+	}
+	if v := out["ok"]["ClusterStatus.green"]; v.Statistic != metricsTypeMinimum || v.Timestamp == nil || !v.Timestamp.Equal(fakeTime) {
+		t.Errorf("ClusterStatus.green of ok = %v, want the Minimum at %s", v, fakeTime)
+	}
+
+	if err := writeJSON(&buf, []ESPlugin{failingDomain("a"), failingDomain("b")}); err == nil {
+		t.Error("writeJSON() error = nil, want an error when no domain could be fetched")
+	}
+}
+
+func TestWritePrometheusNothingFetched(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writePrometheus(&buf, []ESPlugin{failingDomain("a")}); err == nil {
+		t.Errorf("writePrometheus() error = nil, want an error; wrote %q", buf.String())
+	}
+}
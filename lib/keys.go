@@ -0,0 +1,28 @@
+package mpawselasticsearch
+
+import (
+	"regexp"
+	"strings"
+)
+
+var keySanitizeReg = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// sanitizeKey makes s usable as a single segment of a metric key.
+func sanitizeKey(s string) string {
+	return keySanitizeReg.ReplaceAllString(s, "_")
+}
+
+// normalizeKey maps a CloudWatch metric name to a valid Mackerel metric key.
+// Dots keep separating segments, as in ClusterStatus.green; each segment is
+// sanitized and prefixed with "_" when it is empty or starts with a digit.
+func normalizeKey(name string) string {
+	segments := strings.Split(name, ".")
+	for i, s := range segments {
+		s = sanitizeKey(s)
+		if s == "" || s[0] >= '0' && s[0] <= '9' {
+			s = "_" + s
+		}
+		segments[i] = s
+	}
+	return strings.Join(segments, ".")
+}
@@ -0,0 +1,48 @@
+package mpawselasticsearch
+
+import "testing"
+
+func TestSanitizeKey(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"CPUUtilization", "CPUUtilization"},
+		{"my-domain_1", "my-domain_1"},
+		{"a.b", "a_b"},
+		{"search/latency", "search_latency"},
+		{"ドメイン", "____"},
+		{"café", "caf_"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := sanitizeKey(tt.in); got != tt.want {
+			t.Errorf("sanitizeKey(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"CPUUtilization", "CPUUtilization"},
+		{"ClusterStatus.green", "ClusterStatus.green"},
+		{"Threadpool.search.queue", "Threadpool.search.queue"},
+		{"2xx", "_2xx"},
+		{"Requests.5xx", "Requests._5xx"},
+		{"a..b", "a._.b"},
+		{".a", "_.a"},
+		{"a.", "a._"},
+		{"", "_"},
+		{"Latency (ms)", "Latency__ms_"},
+		{"Größe.µs", "Gr__e._s"},
+		{"é", "_"},
+	}
+	for _, tt := range tests {
+		if got := normalizeKey(tt.in); got != tt.want {
+			t.Errorf("normalizeKey(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
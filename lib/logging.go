@@ -0,0 +1,21 @@
+package mpawselasticsearch
+
+import "log"
+
+// The standard logger goes to the log of mackerel-agent, so levels are
+// prefixes. Errors and warnings are always written, debug messages only with
+// -verbose.
+
+func errorf(format string, v ...any) {
+	log.Printf("error: "+format, v...)
+}
+
+func warnf(format string, v ...any) {
+	log.Printf("warning: "+format, v...)
+}
+
+func (p ESPlugin) debugf(format string, v ...any) {
+	if p.Verbose {
+		log.Printf("debug: %s: "+format, append([]any{p.Domain}, v...)...)
+	}
+}
@@ -0,0 +1,120 @@
+package mpawselasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// forDomains returns a copy of p for each of the comma separated names.
+func (p ESPlugin) forDomains(names []string) []ESPlugin {
+	var domains []ESPlugin
+	for _, name := range names {
+		d := p
+		d.Domain = strings.TrimSpace(name)
+		domains = append(domains, d)
+	}
+	return domains
+}
+
+// checkKeyPrefix checks where -metric-key-prefix has the domain placeholder.
+// With several domains, all metrics are posted under one prefix followed by
+// the domain, so the placeholder can only be the last part.
+func checkKeyPrefix(prefix string, domains int) error {
+	n := strings.Count(prefix, domainPlaceholder)
+	if domains < 2 || n == 0 {
+		return nil
+	}
+	if n > 1 || !strings.HasSuffix(prefix, "."+domainPlaceholder) {
+		return fmt.Errorf("invalid metric-key-prefix %q: with several domains %s must be the last part, as in es.%s", prefix, domainPlaceholder, domainPlaceholder)
+	}
+	return nil
+}
+
+// newPlugin returns the plugin polling domains, wrapped for more than one.
+func newPlugin(domains []ESPlugin) mp.PluginWithPrefix {
+	if len(domains) > 1 {
+		return multiDomainPlugin{domains: domains}
+	}
+	return domains[0]
+}
+
+// printGraphDefinition writes the graph definitions of plugin with prefixed
+// keys, like mackerel-agent receives them but indented for diffing.
+func printGraphDefinition(w io.Writer, plugin mp.PluginWithPrefix) error {
+	graphs := make(map[string]mp.Graphs)
+	for key, g := range plugin.GraphDefinition() {
+		graphs[plugin.MetricKeyPrefix()+"."+key] = g
+	}
+	b, err := json.MarshalIndent(mp.GraphDef{Graphs: graphs}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// multiDomainPlugin polls several domains in one run. The metrics of each
+// domain are posted under its sanitized name and graphed per domain with
+// wildcard graph definitions.
+type multiDomainPlugin struct {
+	domains []ESPlugin
+}
+
+// MetricKeyPrefix interface for PluginWithPrefix
+func (m multiDomainPlugin) MetricKeyPrefix() string {
+	// The domain is added to every key anyway, right after the prefix.
+	if prefix, ok := strings.CutSuffix(m.domains[0].KeyPrefix, "."+domainPlaceholder); ok {
+		return prefix
+	}
+	return m.domains[0].MetricKeyPrefix()
+}
+
+// FetchMetrics interface for mackerelplugin
+func (m multiDomainPlugin) FetchMetrics() (map[string]float64, error) {
+	// Metrics of wildcard graphs are keyed by their full name already, the
+	// others have to be prefixed with their graph key like mackerel-plugin does,
+	// once for every graph showing them.
+	graphKeys := make(map[string][]string)
+	for key, g := range m.domains[0].GraphDefinition() {
+		for _, met := range g.Metrics {
+			if strings.ContainsAny(key+met.Name, "*#") {
+				continue
+			}
+			graphKeys[met.Name] = append(graphKeys[met.Name], key)
+		}
+	}
+
+	// A domain that could not be fetched posts Health=0 like a single one.
+	// All domains are fetched within one -timeout.
+	ctx, cancel := m.domains[0].runContext()
+	defer cancel()
+	stat := make(map[string]float64)
+	for _, d := range m.domains {
+		s := d.fetchStat(ctx)
+		prefix := sanitizeKey(d.Domain) + "."
+		for k, v := range s {
+			keys, ok := graphKeys[k]
+			if !ok {
+				stat[prefix+k] = v
+				continue
+			}
+			for _, key := range keys {
+				stat[prefix+key+"."+k] = v
+			}
+		}
+	}
+	return stat, nil
+}
+
+// GraphDefinition interface for mackerelplugin
+func (m multiDomainPlugin) GraphDefinition() map[string]mp.Graphs {
+	graphs := make(map[string]mp.Graphs)
+	for k, g := range m.domains[0].GraphDefinition() {
+		graphs["#."+k] = g
+	}
+	return graphs
+}
@@ -0,0 +1,163 @@
+package mpawselasticsearch
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+func TestMultiDomainFetchMetricsTimeout(t *testing.T) {
+	captureLog(t)
+	const timeout = 200 * time.Millisecond
+	cw := &fakeCloudWatch{stuck: true}
+	p := ESPlugin{CloudWatch: cw, Engine: engineElasticsearch, Period: 60, Lookback: 180, Concurrency: 2, Timeout: timeout}
+	m := multiDomainPlugin{domains: p.forDomains([]string{"a", "b", "c", "d"})}
+	start := time.Now()
+	stat, err := m.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each domain waiting for a -timeout of its own would take 4 of them.
+	if elapsed := time.Since(start); elapsed > 2*timeout {
+		t.Errorf("FetchMetrics returned after %s, want about one timeout of %s", elapsed, timeout)
+	}
+	for _, domain := range []string{"a", "b", "c", "d"} {
+		if v, ok := stat[domain+".Health.Health"]; !ok || v != 0 {
+			t.Errorf("%s.Health.Health = %g (%v), want 0", domain, v, ok)
+		}
+	}
+}
+
+// allFeatures returns a plugin drawing every graph and series there is.
+func allFeatures(t *testing.T) ESPlugin {
+	t.Helper()
+	weights, err := parseHealthWeights("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ESPlugin{
+		TopN:            2,
+		AnomalyBands:    true,
+		SnapshotAge:     true,
+		DetailedStats:   []string{"CPUUtilization", "Nodes", "Shards.active", "Shards.activePrimary"},
+		Percentiles:     []string{"p99", "p99.9"},
+		WithSampleCount: true,
+		ExpectedNodes:   3,
+		VolumeSize:      10,
+		HealthWeights:   weights,
+		Period:          60,
+		Lookback:        180,
+	}
+}
+
+func TestGraphKeysPrefixFree(t *testing.T) {
+	// The wildcard graphs of several domains match a key by its start, so no
+	// key of a graph may start with another one.
+	var keys []string
+	for key, g := range allFeatures(t).GraphDefinition() {
+		for _, m := range g.Metrics {
+			keys = append(keys, key+"."+m.Name)
+		}
+	}
+	for _, a := range keys {
+		for _, b := range keys {
+			if a != b && strings.HasPrefix(b, a) {
+				t.Errorf("%s starts with %s", b, a)
+			}
+		}
+	}
+}
+
+func TestMultiDomainOutputValues(t *testing.T) {
+	captureLog(t)
+	p := allFeatures(t)
+	p.CloudWatch = &fakeCloudWatch{getMetricData: func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+		pages, err := answerQueries(in)
+		// An anomaly detection band comes back as two series of one id.
+		for _, page := range pages {
+			for _, r := range page.MetricDataResults {
+				if strings.HasPrefix(aws.StringValue(r.Id), "band") {
+					page.MetricDataResults = append(page.MetricDataResults, r)
+				}
+			}
+		}
+		return pages, err
+	}}
+	p.Engine = engineElasticsearch
+	p.Concurrency = 2
+	p.Timeout = time.Minute
+	domains := []string{"a", "b"}
+	helper := mp.NewMackerelPlugin(newPlugin(p.forDomains(domains)))
+	helper.Tempfile = filepath.Join(t.TempDir(), "tmp")
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	helper.OutputValues()
+	os.Stdout = stdout
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	perDomain := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		key, _, _ := strings.Cut(line, "\t")
+		if seen[key] {
+			t.Errorf("%s is output more than once", key)
+		}
+		seen[key] = true
+		rest, ok := strings.CutPrefix(key, "es.")
+		domain, _, _ := strings.Cut(rest, ".")
+		if !ok || !slices.Contains(domains, domain) {
+			t.Errorf("%s is not under es.<domain>.", key)
+			continue
+		}
+		perDomain[domain]++
+	}
+	if perDomain["a"] == 0 || perDomain["a"] != perDomain["b"] {
+		t.Errorf("keys per domain = %v, want the same number for each", perDomain)
+	}
+	for _, key := range []string{"es.a.Nodes.Nodes", "es.a.NodesMissing.NodesMissing", "es.b.CPUUtilization.average.CPUUtilization", "es.b.CPUUtilization.expectedUpper.CPUUtilization"} {
+		if !seen[key] {
+			t.Errorf("%s is not output", key)
+		}
+	}
+}
+
+func TestCheckKeyPrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		domains int
+		wantErr bool
+	}{
+		{"es", 1, false},
+		{"es", 3, false},
+		{"es.{domain}", 1, false},
+		{"{domain}.es", 1, false},
+		{"es.{domain}", 2, false},
+		{"{domain}.es", 2, true},
+		{"es.{domain}.x", 2, true},
+		{"es{domain}", 2, true},
+		{"{domain}.{domain}", 2, true},
+	}
+	for _, tt := range tests {
+		err := checkKeyPrefix(tt.prefix, tt.domains)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkKeyPrefix(%q, %d) = %v, want error %v", tt.prefix, tt.domains, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+type nodeMetric struct {
+	metrics
+	// highestIsWorst ranks nodes by descending value, e.g. CPU usage.
+	highestIsWorst bool
+	// unit is the unit of the graph of the metric's ranks.
+	unit string
+}
+
+// topNodeMetrics are the node level metrics ranked by -top-n.
+var topNodeMetrics = []nodeMetric{
+	{metrics{Name: "CPUUtilization", Type: metricsTypeMaximum}, true, "percentage"},
+	{metrics{Name: "JVMMemoryPressure", Type: metricsTypeMaximum}, true, "percentage"},
+	{metrics{Name: "FreeStorageSpace", Type: metricsTypeMinimum}, false, "bytes"},
+}
+
+// topNodeKey is the key of the metric of the node, e.g.
+// topnode.CPUUtilization.<NodeId>, so that the graph of the metric labels the
+// series of each node with its ID.
+func topNodeKey(metricName, nodeID string) string {
+	return "topnode." + metricName + "." + normalizeKey(sanitizeKey(nodeID))
+}
+
+type nodeValue struct {
+	NodeID string
+	Value  float64
+}
+
+// listNodeIDs returns the NodeId dimension values CloudWatch knows for the metric.
+func (p ESPlugin) listNodeIDs(ctx context.Context, metricName string) ([]string, error) {
+	var filters []*cloudwatch.DimensionFilter
+	for _, d := range p.dimensions() {
+		filters = append(filters, &cloudwatch.DimensionFilter{Name: d.Name, Value: d.Value})
+	}
+	filters = append(filters, &cloudwatch.DimensionFilter{Name: aws.String("NodeId")})
+
+	var ids []string
+	err := p.CloudWatch.ListMetricsPagesWithContext(ctx, &cloudwatch.ListMetricsInput{
+		Namespace:  aws.String(p.nameSpace()),
+		MetricName: aws.String(metricName),
+		Dimensions: filters,
+	}, func(page *cloudwatch.ListMetricsOutput, lastPage bool) bool {
+		for _, m := range page.Metrics {
+			for _, d := range m.Dimensions {
+				if aws.StringValue(d.Name) == "NodeId" {
+					ids = append(ids, aws.StringValue(d.Value))
+				}
+			}
+		}
+		return true
+	})
+	return ids, err
+}
+
+// rankNodes returns at most n nodes, worst first.
+func rankNodes(values []nodeValue, highestIsWorst bool, n int) []nodeValue {
+	ranked := make([]nodeValue, len(values))
+	copy(ranked, values)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Value == ranked[j].Value {
+			return ranked[i].NodeID < ranked[j].NodeID
+		}
+		if highestIsWorst {
+			return ranked[i].Value > ranked[j].Value
+		}
+		return ranked[i].Value < ranked[j].Value
+	})
+	if len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+func (p ESPlugin) fetchTopNodes(ctx context.Context, stat map[string]float64) {
+	type nodeQuery struct {
+		metric int
+		nodeID string
+	}
+	var (
+		queries []metricQuery
+		nodes   []nodeQuery
+	)
+	for i, met := range topNodeMetrics {
+		ids, err := p.listNodeIDs(ctx, met.Name)
+		if err != nil {
+			errorf("%s: list nodes of %s: %s", p.Domain, met.Name, err)
+			continue
+		}
+		for _, id := range ids {
+			dimensions := append(p.dimensions(), &cloudwatch.Dimension{
+				Name:  aws.String("NodeId"),
+				Value: aws.String(id),
+			})
+			queries = append(queries, metricQuery{metric: met.metrics, dimensions: dimensions})
+			nodes = append(nodes, nodeQuery{metric: i, nodeID: id})
+		}
+	}
+	if len(queries) == 0 {
+		return
+	}
+
+	points, err := p.getLastPointsFromCloudWatch(ctx, queries)
+	if err != nil {
+		errorf("%s: node metrics: %s", p.Domain, err)
+	}
+	values := make([][]nodeValue, len(topNodeMetrics))
+	for i, dp := range points {
+		if dp == nil {
+			continue
+		}
+		n := nodes[i]
+		met := topNodeMetrics[n.metric]
+		values[n.metric] = append(values[n.metric], nodeValue{NodeID: n.nodeID, Value: valueFromDatapoint(dp, met.metrics)})
+	}
+
+	for i, met := range topNodeMetrics {
+		for rank, v := range rankNodes(values[i], met.highestIsWorst, p.TopN) {
+			p.debugf("%s rank %d: node %s (%g)", met.Name, rank+1, v.NodeID, v.Value)
+			stat[topNodeKey(met.Name, v.NodeID)] = v.Value
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func TestRankNodes(t *testing.T) {
+	values := []nodeValue{
+		{NodeID: "c", Value: 50},
+		{NodeID: "a", Value: 90},
+		{NodeID: "d", Value: 10},
+		{NodeID: "b", Value: 50},
+	}
+	tests := []struct {
+		name           string
+		highestIsWorst bool
+		n              int
+		want           []string
+	}{
+		{"highest first", true, 4, []string{"a", "b", "c", "d"}},
+		{"lowest first", false, 4, []string{"d", "b", "c", "a"}},
+		{"top 2", true, 2, []string{"a", "b"}},
+		{"more than nodes", false, 10, []string{"d", "b", "c", "a"}},
+		{"none", true, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, v := range rankNodes(values, tt.highestIsWorst, tt.n) {
+				got = append(got, v.NodeID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("rankNodes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if values[0].NodeID != "c" {
+		t.Errorf("rankNodes() reordered its input: %v", values)
+	}
+}
+
+func TestFetchTopNodes(t *testing.T) {
+	// The value of a node is its position in the listing, scaled for
+	// FreeStorageSpace, which is in MB.
+	nodes := []string{"n1", "n2", "n3"}
+	cw := &fakeCloudWatch{
+		listMetrics: func(in *cloudwatch.ListMetricsInput) ([]*cloudwatch.ListMetricsOutput, error) {
+			out := &cloudwatch.ListMetricsOutput{}
+			for _, id := range nodes {
+				out.Metrics = append(out.Metrics, &cloudwatch.Metric{
+					MetricName: in.MetricName,
+					Dimensions: []*cloudwatch.Dimension{{Name: aws.String("NodeId"), Value: aws.String(id)}},
+				})
+			}
+			return []*cloudwatch.ListMetricsOutput{out}, nil
+		},
+		getMetricData: func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+			values := make(map[string]float64)
+			for _, q := range in.MetricDataQueries {
+				for _, d := range q.MetricStat.Metric.Dimensions {
+					if aws.StringValue(d.Name) == "NodeId" {
+						values[aws.StringValue(q.Id)] = float64(slices.Index(nodes, aws.StringValue(d.Value)) + 1)
+					}
+				}
+			}
+			pages, _ := answerQueries(in)
+			for _, r := range pages[0].MetricDataResults {
+				r.Values = []*float64{aws.Float64(values[aws.StringValue(r.Id)])}
+			}
+			return pages, nil
+		},
+	}
+	p := ESPlugin{Domain: "d", CloudWatch: cw, Period: 60, Lookback: 180, TopN: 2}
+	stat := make(map[string]float64)
+	p.fetchTopNodes(context.Background(), stat)
+
+	want := map[string]float64{
+		"topnode.CPUUtilization.n3":    3,
+		"topnode.CPUUtilization.n2":    2,
+		"topnode.JVMMemoryPressure.n3": 3,
+		"topnode.JVMMemoryPressure.n2": 2,
+		"topnode.FreeStorageSpace.n1":  1 * 1024 * 1024,
+		"topnode.FreeStorageSpace.n2":  2 * 1024 * 1024,
+	}
+	if len(stat) != len(want) {
+		t.Errorf("fetchTopNodes() = %v, want %v", stat, want)
+	}
+	for k, v := range want {
+		if stat[k] != v {
+			t.Errorf("%s = %g, want %g", k, stat[k], v)
+		}
+	}
+}
+
+func TestTopNodeGraphDefinitions(t *testing.T) {
+	graphs := ESPlugin{TopN: 3}.GraphDefinition()
+	for key, unit := range map[string]string{
+		"topnode.CPUUtilization":    "percentage",
+		"topnode.JVMMemoryPressure": "percentage",
+		"topnode.FreeStorageSpace":  "bytes",
+	} {
+		g, ok := graphs[key]
+		if !ok {
+			t.Errorf("no graph %s", key)
+			continue
+		}
+		if g.Unit != unit {
+			t.Errorf("unit of %s = %s, want %s", key, g.Unit, unit)
+		}
+	}
+}
+
+func TestTopNodeKey(t *testing.T) {
+	tests := []struct {
+		metric string
+		nodeID string
+		want   string
+	}{
+		{"CPUUtilization", "TJ8Gx6W1QqGFNkQ7R0O-Jw", "topnode.CPUUtilization.TJ8Gx6W1QqGFNkQ7R0O-Jw"},
+		{"FreeStorageSpace", "node_1", "topnode.FreeStorageSpace.node_1"},
+		// A node ID stays a single segment of the key.
+		{"JVMMemoryPressure", "a.b/c", "topnode.JVMMemoryPressure.a_b_c"},
+		{"CPUUtilization", "1abc", "topnode.CPUUtilization._1abc"},
+	}
+	for _, tt := range tests {
+		if got := topNodeKey(tt.metric, tt.nodeID); got != tt.want {
+			t.Errorf("topNodeKey(%q, %q) = %q, want %q", tt.metric, tt.nodeID, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package mpawselasticsearch
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Defaults of the flags, also used by New for zero Options.
+const (
+	defaultPeriod      = 60
+	defaultLookback    = 180
+	defaultConcurrency = 5
+	defaultTimeout     = 30 * time.Second
+	defaultMaxRetries  = 3
+)
+
+// Options configure an ESPlugin created with New. Zero values mean the
+// defaults of the corresponding flags.
+type Options struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Profile         string
+	RoleARN         string
+	ExternalID      string
+	Endpoint        string
+	Partition       string
+	Domain          string
+	// ClientID is detected with STS when empty.
+	ClientID    string
+	KeyPrefix   string
+	LabelPrefix string
+	// Engine is es, opensearch or auto, detected with DescribeDomain.
+	Engine      string
+	Serverless  bool
+	Namespace   string
+	Period      int64
+	Lookback    int64
+	Concurrency int
+	Timeout     time.Duration
+	// MaxRetries is the default of -max-retries when nil, so that zero can
+	// disable retries.
+	MaxRetries *int
+}
+
+// New returns a plugin ready to call FetchMetrics and GraphDefinition on, for
+// embedding the collector instead of running it with Do. It creates the AWS
+// clients and resolves what Do otherwise caches between runs.
+func New(opts Options) (*ESPlugin, error) {
+	p := &ESPlugin{
+		Region:          opts.Region,
+		AccessKeyID:     opts.AccessKeyID,
+		SecretAccessKey: opts.SecretAccessKey,
+		SessionToken:    opts.SessionToken,
+		Profile:         opts.Profile,
+		RoleARN:         opts.RoleARN,
+		ExternalID:      opts.ExternalID,
+		Endpoint:        opts.Endpoint,
+		Partition:       opts.Partition,
+		Domain:          opts.Domain,
+		ClientID:        opts.ClientID,
+		KeyPrefix:       opts.KeyPrefix,
+		LabelPrefix:     opts.LabelPrefix,
+		Engine:          opts.Engine,
+		Serverless:      opts.Serverless,
+		Namespace:       opts.Namespace,
+		Period:          opts.Period,
+		Lookback:        opts.Lookback,
+		Concurrency:     opts.Concurrency,
+		Timeout:         opts.Timeout,
+		MaxRetries:      defaultMaxRetries,
+	}
+	if p.Period == 0 {
+		p.Period = defaultPeriod
+	}
+	if p.Lookback == 0 {
+		p.Lookback = max(defaultLookback, p.Period)
+	}
+	if p.Concurrency == 0 {
+		p.Concurrency = defaultConcurrency
+	}
+	if p.Timeout == 0 {
+		p.Timeout = defaultTimeout
+	}
+	if opts.MaxRetries != nil {
+		p.MaxRetries = *opts.MaxRetries
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	switch p.Engine {
+	case "":
+		p.Engine = engineAuto
+	case engineAuto, engineElasticsearch, engineOpenSearch:
+	default:
+		return nil, fmt.Errorf("invalid engine %q: expected es, opensearch or auto", p.Engine)
+	}
+	weights, err := parseHealthWeights("")
+	if err != nil {
+		return nil, err
+	}
+	p.HealthWeights = weights
+
+	var lookups lookupCache
+	if p.Region == "" {
+		region, err := resolveRegion(p.Profile, &lookups)
+		if err != nil {
+			return nil, err
+		}
+		p.Region = region
+	}
+	if err := p.prepare(); err != nil {
+		return nil, err
+	}
+	if err := p.detectClientID(&lookups); err != nil {
+		return nil, err
+	}
+	ctx, cancel := p.runContext()
+	defer cancel()
+	var st pluginState
+	if p.Serverless {
+		p.Engine = ""
+		p.resolveCollectionName(ctx, &st)
+		return p, nil
+	}
+	p.resolveEngine(ctx, &st)
+	p.resolveDimensionSet(ctx, &st)
+	return p, nil
+}
+
+// validate checks the settings Do takes from flags and New from Options.
+func (p ESPlugin) validate() error {
+	if p.Period <= 0 {
+		return fmt.Errorf("invalid period %d: must be positive", p.Period)
+	}
+	if p.Lookback < p.Period {
+		return fmt.Errorf("invalid lookback %d: must be at least one period (%d)", p.Lookback, p.Period)
+	}
+
+	if p.Serverless && p.DiscoverThreadpools {
+		return errors.New("-discover-threadpools is not available with -serverless: collections have no threadpools")
+	}
+	if p.Serverless && p.SnapshotAge {
+		return errors.New("-snapshot-age is not available with -serverless: collections have no automated snapshots")
+	}
+	if p.Serverless && p.TopN > 0 {
+		return errors.New("-top-n is not available with -serverless: collections have no nodes")
+	}
+
+	if p.VolumeSize < 0 {
+		return fmt.Errorf("invalid volume-size %d: must not be negative", p.VolumeSize)
+	}
+	if p.ExpectedNodes < 0 {
+		return fmt.Errorf("invalid expected-nodes %d: must not be negative", p.ExpectedNodes)
+	}
+	if p.Serverless && p.ExpectedNodes > 0 {
+		return errors.New("-expected-nodes is not available with -serverless: collections have no nodes")
+	}
+
+	if p.Concurrency < 1 {
+		return fmt.Errorf("invalid concurrency %d: must be at least 1", p.Concurrency)
+	}
+
+	if p.Timeout <= 0 {
+		return fmt.Errorf("invalid timeout %s: must be positive", p.Timeout)
+	}
+	if p.MaxRetries < 0 {
+		return fmt.Errorf("invalid max-retries %d: must not be negative", p.MaxRetries)
+	}
+
+	// Without a positive weight DomainHealthScore would never be posted.
+	if p.HealthWeights != nil {
+		var total float64
+		for _, w := range p.HealthWeights {
+			total += w
+		}
+		if total <= 0 {
+			return errors.New("invalid health-weights: at least one weight must be positive")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package mpawselasticsearch
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func TestNewValidates(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"period", Options{Period: -60}, "invalid period -60"},
+		{"lookback", Options{Period: 300, Lookback: 60}, "invalid lookback 60"},
+		{"concurrency", Options{Concurrency: -1}, "invalid concurrency -1"},
+		{"timeout", Options{Timeout: -time.Second}, "invalid timeout -1s"},
+		{"max retries", Options{MaxRetries: aws.Int(-1)}, "invalid max-retries -1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Region = "us-east-1"
+			tt.opts.Domain = "d"
+			tt.opts.ClientID = "1"
+			_, err := New(tt.opts)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("New() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMaxRetries(t *testing.T) {
+	captureLog(t)
+	tests := []struct {
+		name       string
+		maxRetries *int
+		want       int
+	}{
+		{"default", nil, defaultMaxRetries},
+		{"zero", aws.Int(0), 0},
+		{"given", aws.Int(5), 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Nothing listens on the endpoint, so probing the dimension set fails
+			// at once.
+			p, err := New(Options{
+				Region:          "us-east-1",
+				AccessKeyID:     "x",
+				SecretAccessKey: "y",
+				Endpoint:        "http://127.0.0.1:1",
+				Domain:          "d",
+				ClientID:        "1",
+				Engine:          engineElasticsearch,
+				Timeout:         200 * time.Millisecond,
+				MaxRetries:      tt.maxRetries,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.MaxRetries != tt.want {
+				t.Errorf("MaxRetries = %d, want %d", p.MaxRetries, tt.want)
+			}
+			if got := p.CloudWatch.(*cloudwatch.CloudWatch).Config.MaxRetries; aws.IntValue(got) != tt.want {
+				t.Errorf("MaxRetries of CloudWatch = %d, want %d", aws.IntValue(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateHealthWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights string
+		wantErr bool
+	}{
+		{"default", "", false},
+		{"some zero", "snapshot=0,writes=0", false},
+		{"all zero", "status=0,jvm=0,storage=0,writes=0,snapshot=0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			weights, err := parseHealthWeights(tt.weights)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := ESPlugin{Period: 60, Lookback: 180, Concurrency: 1, Timeout: time.Second, HealthWeights: weights}
+			if err := p.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
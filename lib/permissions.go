@@ -0,0 +1,113 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/opensearchservice"
+)
+
+// permissionCheck is an IAM action the flags need and a cheap call using it.
+type permissionCheck struct {
+	action string
+	// feature is what needs the action when it is optional.
+	feature string
+	call    func(ctx context.Context) error
+}
+
+func (p ESPlugin) permissionChecks() []permissionCheck {
+	checks := []permissionCheck{
+		{
+			action: "cloudwatch:GetMetricData",
+			call: func(ctx context.Context) error {
+				_, err := p.getLastPointsFromCloudWatch(ctx, []metricQuery{{metric: p.builtinMetrics()[0], dimensions: p.dimensions()}})
+				return err
+			},
+		},
+	}
+	if p.Engine == engineAuto {
+		checks = append(checks, permissionCheck{
+			action:  "es:DescribeDomain",
+			feature: "-engine=auto",
+			call: func(ctx context.Context) error {
+				_, err := p.OpenSearch.DescribeDomainWithContext(ctx, &opensearchservice.DescribeDomainInput{
+					DomainName: aws.String(p.Domain),
+				})
+				return err
+			},
+		})
+	}
+	var listing []string
+	if p.TopN > 0 {
+		listing = append(listing, "-top-n")
+	}
+	if p.Discover {
+		listing = append(listing, "-discover")
+	}
+	if p.DiscoverThreadpools {
+		listing = append(listing, "-discover-threadpools")
+	}
+	if p.Serverless {
+		listing = append(listing, "-serverless")
+	}
+	if len(listing) > 0 {
+		checks = append(checks, permissionCheck{
+			action:  "cloudwatch:ListMetrics",
+			feature: strings.Join(listing, " and "),
+			call: func(ctx context.Context) error {
+				_, err := p.listNodeIDs(ctx, topNodeMetrics[0].Name)
+				return err
+			},
+		})
+	}
+	return checks
+}
+
+// checkPermissions makes one call per IAM action the flags need and prints
+// whether it is allowed. It reports false when a required action failed.
+func (p ESPlugin) checkPermissions(w io.Writer) bool {
+	ctx, cancel := p.runContext()
+	defer cancel()
+
+	ok := true
+	for _, c := range p.permissionChecks() {
+		err := c.call(ctx)
+		switch {
+		case err == nil:
+			fmt.Fprintf(w, "OK      %s\n", c.action)
+			continue
+		case isAccessDenied(err):
+			fmt.Fprintf(w, "DENIED  %s: allow it in the IAM policy of the plugin's credentials", c.action)
+		default:
+			fmt.Fprintf(w, "ERROR   %s: %s", c.action, err)
+		}
+		if c.feature != "" {
+			fmt.Fprintf(w, " (only needed for %s)\n", c.feature)
+			continue
+		}
+		fmt.Fprintln(w)
+		ok = false
+	}
+	return ok
+}
+
+// checkDomainsPermissions checks the permissions of every domain, each under
+// a line naming it when there are several, and reports whether all passed.
+func checkDomainsPermissions(w io.Writer, domains []ESPlugin) bool {
+	ok := true
+	for i, d := range domains {
+		if len(domains) > 1 {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "%s:\n", d.Domain)
+		}
+		if !d.checkPermissions(w) {
+			ok = false
+		}
+	}
+	return ok
+}
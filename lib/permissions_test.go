@@ -0,0 +1,46 @@
+package mpawselasticsearch
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func TestCheckDomainsPermissions(t *testing.T) {
+	// GetMetricData is denied for the domain b only, e.g. by a condition on
+	// its DomainName.
+	cw := &fakeCloudWatch{getMetricData: func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+		for _, d := range in.MetricDataQueries[0].MetricStat.Metric.Dimensions {
+			if aws.StringValue(d.Name) == "DomainName" && aws.StringValue(d.Value) == "b" {
+				return nil, awserr.New("AccessDenied", "denied", nil)
+			}
+		}
+		return answerQueries(in)
+	}}
+	p := ESPlugin{CloudWatch: cw, Engine: engineElasticsearch, Period: 60, Lookback: 180}
+
+	tests := []struct {
+		name    string
+		domains []string
+		want    string
+		wantOK  bool
+	}{
+		{"one", []string{"a"}, "OK      cloudwatch:GetMetricData\n", true},
+		{"all", []string{"a", "c"}, "a:\nOK      cloudwatch:GetMetricData\n\nc:\nOK      cloudwatch:GetMetricData\n", true},
+		{"not the first", []string{"a", "b"}, "a:\nOK      cloudwatch:GetMetricData\n\nb:\nDENIED  cloudwatch:GetMetricData: allow it in the IAM policy of the plugin's credentials\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			if ok := checkDomainsPermissions(&out, p.forDomains(tt.domains)); ok != tt.wantOK {
+				t.Errorf("checkDomainsPermissions() = %v, want %v", ok, tt.wantOK)
+			}
+			if out.String() != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package mpawselasticsearch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Output formats of -format.
+const (
+	formatMackerel   = "mackerel"
+	formatPrometheus = "prometheus"
+)
+
+const prometheusPrefix = "aws_es_"
+
+var prometheusNameReg = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// prometheusName turns a metric key into a Prometheus metric name, e.g.
+// ClusterStatus.green into aws_es_ClusterStatus_green.
+func prometheusName(key string) string {
+	return prometheusPrefix + prometheusNameReg.ReplaceAllString(key, "_")
+}
+
+type prometheusSample struct {
+	domain string
+	region string
+	value  float64
+}
+
+// writePrometheus fetches the metrics of the domains and writes them in the
+// Prometheus text exposition format, e.g. for the textfile collector of
+// node_exporter. Domains that could not be fetched are left out, and it fails
+// only when no domain could be fetched.
+func writePrometheus(w io.Writer, domains []ESPlugin) error {
+	samples := make(map[string][]prometheusSample)
+	var errs []error
+	ctx, cancel := domains[0].runContext()
+	defer cancel()
+	for _, d := range domains {
+		stat, _, err := d.fetchMetrics(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.Domain, err))
+			continue
+		}
+		scales := make(map[string]float64)
+		for _, g := range d.GraphDefinition() {
+			for _, met := range g.Metrics {
+				if met.Scale != 0 {
+					scales[met.Name] = met.Scale
+				}
+			}
+		}
+		for k, v := range stat {
+			if scale, ok := scales[k]; ok {
+				v *= scale
+			}
+			name := prometheusName(k)
+			samples[name] = append(samples[name], prometheusSample{domain: d.Domain, region: d.Region, value: v})
+		}
+	}
+	if len(errs) == len(domains) {
+		return errors.Join(errs...)
+	}
+	for _, err := range errs {
+		errorf("%s", err)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(samples)) {
+		if _, err := fmt.Fprintf(w, "# TYPE %s gauge\n", name); err != nil {
+			return err
+		}
+		for _, s := range samples[name] {
+			_, err := fmt.Fprintf(w, "%s{domain=\"%s\",region=\"%s\"} %s\n", name,
+				prometheusLabelEscaper.Replace(s.domain),
+				prometheusLabelEscaper.Replace(s.region),
+				strconv.FormatFloat(s.value, 'g', -1, 64))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
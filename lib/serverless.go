@@ -0,0 +1,159 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"slices"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// OpenSearch Serverless publishes under its own namespace, per collection
+// instead of per domain.
+const serverlessNameSpace = "AWS/AOSS"
+
+var serverlessMetrics = []metrics{
+	{Name: "SearchRequestRate", Type: metricsTypeSum},
+	{Name: "SearchRequestErrors", Type: metricsTypeSum},
+	{Name: "SearchRequestLatency", Type: metricsTypeAverage},
+	{Name: "IngestionRequestRate", Type: metricsTypeSum},
+	{Name: "IngestionRequestErrors", Type: metricsTypeSum},
+	{Name: "IngestionRequestLatency", Type: metricsTypeAverage},
+	{Name: "IngestionDocumentRate", Type: metricsTypeSum},
+	{Name: "SearchableDocuments", Type: metricsTypeMaximum},
+	{Name: "StorageUsedInS3", Type: metricsTypeMaximum},
+	{Name: "SearchOCU", Type: metricsTypeMaximum},
+	{Name: "IndexingOCU", Type: metricsTypeMaximum},
+}
+
+// accountLevelServerlessMetrics are published for the whole account, under
+// the ClientId dimension only.
+var accountLevelServerlessMetrics = []string{"SearchOCU", "IndexingOCU"}
+
+func (p ESPlugin) nameSpace() string {
+	if p.Namespace != "" {
+		return p.Namespace
+	}
+	if p.Serverless {
+		return serverlessNameSpace
+	}
+	return nameSpace
+}
+
+// metricDimensions returns the dimensions met is published under. The
+// account level metrics are published under ClientId only, so neither
+// CollectionName nor -dimension apply to them.
+func (p ESPlugin) metricDimensions(met metrics) []*cloudwatch.Dimension {
+	if p.Serverless && slices.Contains(accountLevelServerlessMetrics, met.Name) {
+		return []*cloudwatch.Dimension{{
+			Name:  aws.String("ClientId"),
+			Value: aws.String(p.ClientID),
+		}}
+	}
+	return p.dimensions()
+}
+
+// resolveCollectionName uses the collection name cached in st, or looks it
+// up and caches it. When -dimension gives it, nothing is looked up. That the
+// metrics of the collection have none is cached as well; when none are listed
+// yet, it is looked up again next run.
+func (p *ESPlugin) resolveCollectionName(ctx context.Context, st *pluginState) {
+	for _, d := range p.ExtraDimensions {
+		if aws.StringValue(d.Name) == "CollectionName" {
+			return
+		}
+	}
+	if st.CollectionName != "" || st.NoCollectionName {
+		p.CollectionName = st.CollectionName
+		return
+	}
+	name, listed, err := p.lookupCollectionName(ctx)
+	if err != nil {
+		errorf("%s: look up the collection name: %s", p.Domain, err)
+		return
+	}
+	p.CollectionName = name
+	st.CollectionName = name
+	st.NoCollectionName = listed && name == ""
+}
+
+// lookupCollectionName returns the CollectionName dimension CloudWatch lists
+// the metrics of the collection under, or "" when there is none, and whether
+// any metric of the collection was listed.
+func (p ESPlugin) lookupCollectionName(ctx context.Context) (string, bool, error) {
+	var (
+		name   string
+		listed bool
+	)
+	err := p.CloudWatch.ListMetricsPagesWithContext(ctx, &cloudwatch.ListMetricsInput{
+		Namespace: aws.String(p.nameSpace()),
+		Dimensions: []*cloudwatch.DimensionFilter{
+			{Name: aws.String("CollectionId"), Value: aws.String(p.Domain)},
+		},
+	}, func(page *cloudwatch.ListMetricsOutput, lastPage bool) bool {
+		for _, m := range page.Metrics {
+			listed = true
+			for _, d := range m.Dimensions {
+				if aws.StringValue(d.Name) == "CollectionName" {
+					name = aws.StringValue(d.Value)
+					return false
+				}
+			}
+		}
+		return true
+	})
+	return name, listed, err
+}
+
+func serverlessGraphDefinition(labelPrefix string) map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		"SearchRequests": {
+			Label: (labelPrefix + " Search Requests"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "SearchRequestRate", Label: "Requests"},
+				{Name: "SearchRequestErrors", Label: "Errors"},
+			},
+		},
+		"IngestionRequests": {
+			Label: (labelPrefix + " Ingestion Requests"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "IngestionRequestRate", Label: "Requests"},
+				{Name: "IngestionRequestErrors", Label: "Errors"},
+				{Name: "IngestionDocumentRate", Label: "Documents"},
+			},
+		},
+		"RequestLatency": {
+			Label: (labelPrefix + " Request Latency"),
+			Unit:  "milliseconds",
+			Metrics: []mp.Metrics{
+				{Name: "SearchRequestLatency", Label: "Search"},
+				{Name: "IngestionRequestLatency", Label: "Ingestion"},
+			},
+		},
+		"SearchableDocuments": {
+			Label: (labelPrefix + " Searchable Documents"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "SearchableDocuments", Label: "SearchableDocuments"},
+			},
+		},
+		"StorageUsedInS3": {
+			Label: (labelPrefix + " Storage Used In S3"),
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "StorageUsedInS3", Label: "StorageUsedInS3"},
+			},
+		},
+		"OCU": {
+			Label: (labelPrefix + " OCU"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "SearchOCU", Label: "Search"},
+				{Name: "IndexingOCU", Label: "Indexing"},
+			},
+		},
+	}
+}
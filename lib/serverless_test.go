@@ -0,0 +1,97 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func TestMetricDimensionsServerless(t *testing.T) {
+	p := ESPlugin{
+		Domain:         "abc123",
+		ClientID:       "123456789012",
+		Serverless:     true,
+		CollectionName: "logs",
+		ExtraDimensions: []*cloudwatch.Dimension{
+			{Name: aws.String("Team"), Value: aws.String("search")},
+		},
+	}
+	tests := []struct {
+		metric string
+		want   string
+	}{
+		{"SearchRequestRate", "CollectionId=abc123,CollectionName=logs,ClientId=123456789012,Team=search"},
+		{"SearchOCU", "ClientId=123456789012"},
+		{"IndexingOCU", "ClientId=123456789012"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.metric, func(t *testing.T) {
+			f := dimensionFlag(p.metricDimensions(metrics{Name: tt.metric}))
+			if got := f.String(); got != tt.want {
+				t.Errorf("metricDimensions(%s) = %s, want %s", tt.metric, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveCollectionName(t *testing.T) {
+	listed := func(in *cloudwatch.ListMetricsInput) ([]*cloudwatch.ListMetricsOutput, error) {
+		return []*cloudwatch.ListMetricsOutput{{Metrics: []*cloudwatch.Metric{
+			{MetricName: aws.String("SearchOCU"), Dimensions: []*cloudwatch.Dimension{
+				{Name: aws.String("ClientId"), Value: aws.String("123456789012")},
+			}},
+			{MetricName: aws.String("SearchRequestRate"), Dimensions: []*cloudwatch.Dimension{
+				{Name: aws.String("CollectionId"), Value: aws.String("abc123")},
+				{Name: aws.String("CollectionName"), Value: aws.String("logs")},
+				{Name: aws.String("ClientId"), Value: aws.String("123456789012")},
+			}},
+		}}}, nil
+	}
+	tests := []struct {
+		name      string
+		st        pluginState
+		extra     []*cloudwatch.Dimension
+		list      func(*cloudwatch.ListMetricsInput) ([]*cloudwatch.ListMetricsOutput, error)
+		want      string
+		wantState string
+		wantNone  bool
+		wantCalls int
+	}{
+		{name: "looked up", list: listed, want: "logs", wantState: "logs", wantCalls: 1},
+		{name: "cached", st: pluginState{CollectionName: "cached"}, list: listed, want: "cached", wantState: "cached"},
+		{
+			name:  "given by -dimension",
+			extra: []*cloudwatch.Dimension{{Name: aws.String("CollectionName"), Value: aws.String("given")}},
+			list:  listed,
+		},
+		{
+			name: "metrics without it",
+			list: func(in *cloudwatch.ListMetricsInput) ([]*cloudwatch.ListMetricsOutput, error) {
+				return []*cloudwatch.ListMetricsOutput{{Metrics: []*cloudwatch.Metric{{MetricName: aws.String("SearchRequestRate")}}}}, nil
+			},
+			wantNone:  true,
+			wantCalls: 1,
+		},
+		{name: "cached without it", st: pluginState{NoCollectionName: true}, list: listed, wantNone: true},
+		{name: "no metrics yet", wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cw := &fakeCloudWatch{listMetrics: tt.list}
+			p := ESPlugin{Domain: "abc123", Serverless: true, CloudWatch: cw, ExtraDimensions: tt.extra}
+			st := tt.st
+			p.resolveCollectionName(context.Background(), &st)
+			if p.CollectionName != tt.want || st.CollectionName != tt.wantState {
+				t.Errorf("CollectionName = %q, cached %q, want %q, cached %q", p.CollectionName, st.CollectionName, tt.want, tt.wantState)
+			}
+			if st.NoCollectionName != tt.wantNone {
+				t.Errorf("NoCollectionName = %v, want %v", st.NoCollectionName, tt.wantNone)
+			}
+			if cw.listMetricsCalled != tt.wantCalls {
+				t.Errorf("ListMetrics called %d times, want %d", cw.listMetricsCalled, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// Automated snapshots are taken hourly, so AutomatedSnapshotFailure is
+// looked at per hour, as far back as snapshotAgeLookback.
+const (
+	snapshotAgePeriod   = 3600
+	snapshotAgeLookback = 7 * 24 * 3600
+)
+
+// fetchSnapshotAge stores as SnapshotAgeSeconds how long ago the latest hour
+// without AutomatedSnapshotFailure ended, approximating the age of the last
+// successful automated snapshot. When every hour of snapshotAgeLookback
+// failed, it is snapshotAgeLookback. Nothing is stored when the metric has no
+// datapoint at all.
+func (p ESPlugin) fetchSnapshotAge(ctx context.Context, stat map[string]float64) error {
+	fetched := slices.ContainsFunc(p.metricList(), func(met metrics) bool {
+		return met.Name == "AutomatedSnapshotFailure"
+	})
+	if !fetched {
+		return nil
+	}
+
+	now := time.Now()
+	input := &cloudwatch.GetMetricDataInput{
+		MetricDataQueries: []*cloudwatch.MetricDataQuery{
+			{
+				Id: aws.String("m0"),
+				MetricStat: &cloudwatch.MetricStat{
+					Metric: &cloudwatch.Metric{
+						Namespace:  aws.String(p.nameSpace()),
+						MetricName: aws.String("AutomatedSnapshotFailure"),
+						Dimensions: p.dimensions(),
+					},
+					Period: aws.Int64(snapshotAgePeriod),
+					Stat:   aws.String(metricsTypeMaximum),
+				},
+			},
+		},
+		StartTime: aws.Time(now.Add(snapshotAgeLookback * time.Second * -1)),
+		EndTime:   aws.Time(now),
+		ScanBy:    aws.String(cloudwatch.ScanByTimestampDescending),
+	}
+
+	var (
+		found bool
+		clean *time.Time
+	)
+	err := p.CloudWatch.GetMetricDataPagesWithContext(ctx, input, func(page *cloudwatch.GetMetricDataOutput, lastPage bool) bool {
+		for _, r := range page.MetricDataResults {
+			for j, ts := range r.Timestamps {
+				if j >= len(r.Values) || ts == nil || r.Values[j] == nil {
+					continue
+				}
+				found = true
+				if *r.Values[j] == 0 && (clean == nil || ts.After(*clean)) {
+					clean = ts
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case clean != nil:
+		end := clean.Add(snapshotAgePeriod * time.Second)
+		stat["SnapshotAgeSeconds"] = max(now.Sub(end).Seconds(), 0)
+	case found:
+		stat["SnapshotAgeSeconds"] = snapshotAgeLookback
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package mpawselasticsearch
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// answerSnapshotFailures answers the query of AutomatedSnapshotFailure with a
+// datapoint per hour, the first of them the given hours ago, newest first.
+func answerSnapshotFailures(hoursAgo int, failures ...float64) func(*cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+	return func(in *cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error) {
+		latest := time.Now().Truncate(time.Hour).Add(time.Duration(-hoursAgo) * time.Hour)
+		r := &cloudwatch.MetricDataResult{Id: in.MetricDataQueries[0].Id, StatusCode: aws.String(cloudwatch.StatusCodeComplete)}
+		for i, v := range failures {
+			r.Timestamps = append(r.Timestamps, aws.Time(latest.Add(time.Duration(-i)*time.Hour)))
+			r.Values = append(r.Values, aws.Float64(v))
+		}
+		return []*cloudwatch.GetMetricDataOutput{{MetricDataResults: []*cloudwatch.MetricDataResult{r}}}, nil
+	}
+}
+
+func TestFetchSnapshotAge(t *testing.T) {
+	tests := []struct {
+		name          string
+		getMetricData func(*cloudwatch.GetMetricDataInput) ([]*cloudwatch.GetMetricDataOutput, error)
+		// want is the hour the latest snapshot succeeded in, as hours ago.
+		want   float64
+		wantOK bool
+	}{
+		{
+			name:          "last snapshot 3 hours ago",
+			getMetricData: answerSnapshotFailures(1, 1, 1, 0, 1),
+			want:          3,
+			wantOK:        true,
+		},
+		{
+			name:          "last snapshot in the latest hour",
+			getMetricData: answerSnapshotFailures(1, 0, 1),
+			want:          1,
+			wantOK:        true,
+		},
+		{
+			name:          "no snapshot in the window",
+			getMetricData: answerSnapshotFailures(1, 1, 1, 1),
+			wantOK:        true,
+		},
+		{
+			name:          "no datapoint",
+			getMetricData: answerSnapshotFailures(1),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cw := &fakeCloudWatch{getMetricData: tt.getMetricData}
+			p := ESPlugin{Domain: "d", ClientID: "1", CloudWatch: cw, Engine: engineElasticsearch, SnapshotAge: true, Period: 60, Lookback: 180}
+			stat := make(map[string]float64)
+			if err := p.fetchSnapshotAge(context.Background(), stat); err != nil {
+				t.Fatal(err)
+			}
+			got, ok := stat["SnapshotAgeSeconds"]
+			if ok != tt.wantOK {
+				t.Fatalf("SnapshotAgeSeconds = %g (%v), want it stored %v", got, ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			// The age is counted from the end of the hour of the snapshot.
+			want := float64(snapshotAgeLookback)
+			if tt.want > 0 {
+				end := time.Now().Truncate(time.Hour).Add(time.Duration(1-tt.want) * time.Hour)
+				want = time.Since(end).Seconds()
+			}
+			if math.Abs(got-want) > 5 {
+				t.Errorf("SnapshotAgeSeconds = %g, want %g", got, want)
+			}
+
+			calls := cw.calls()
+			if len(calls) != 1 {
+				t.Fatalf("%d calls, want one", len(calls))
+			}
+			q := calls[0].MetricDataQueries[0].MetricStat
+			if aws.StringValue(q.Metric.MetricName) != "AutomatedSnapshotFailure" || aws.Int64Value(q.Period) != snapshotAgePeriod {
+				t.Errorf("query = %s, want AutomatedSnapshotFailure per hour", q)
+			}
+			if window := aws.TimeValue(calls[0].EndTime).Sub(aws.TimeValue(calls[0].StartTime)); window != snapshotAgeLookback*time.Second {
+				t.Errorf("window = %s, want %s", window, snapshotAgeLookback*time.Second)
+			}
+		})
+	}
+}
+
+func TestFetchMetricsSnapshotAgeOptIn(t *testing.T) {
+	captureLog(t)
+	for _, enabled := range []bool{false, true} {
+		cw := &fakeCloudWatch{getMetricData: answerByName(map[string]float64{"AutomatedSnapshotFailure": 0})}
+		p := ESPlugin{Domain: "d", ClientID: "1", CloudWatch: cw, Engine: engineElasticsearch, SnapshotAge: enabled, Period: 60, Lookback: 180, Concurrency: 1, Timeout: time.Minute}
+		stat, _, err := p.fetchMetrics(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := stat["SnapshotAgeSeconds"]; ok != enabled {
+			t.Errorf("SnapshotAge %v: SnapshotAgeSeconds stored %v", enabled, ok)
+		}
+		if _, ok := p.GraphDefinition()["SnapshotAge"]; ok != enabled {
+			t.Errorf("SnapshotAge %v: SnapshotAge graph drawn %v", enabled, ok)
+		}
+		for _, in := range cw.calls() {
+			if aws.Int64Value(in.MetricDataQueries[0].MetricStat.Period) == snapshotAgePeriod && !enabled {
+				t.Errorf("snapshot age is fetched without SnapshotAge")
+			}
+		}
+	}
+}
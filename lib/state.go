@@ -0,0 +1,131 @@
+package mpawselasticsearch
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mackerelio/golib/pluginutil"
+)
+
+// pluginState is what the plugin remembers between runs.
+type pluginState struct {
+	// Key is the flagsKey the state was cached with.
+	Key string `json:"key,omitempty"`
+	// Engine is used for EngineRuns runs, up to lookupRefreshRuns, before the
+	// domain is described again, e.g. after an upgrade to OpenSearch.
+	Engine       string `json:"engine,omitempty"`
+	EngineRuns   int    `json:"engineRuns,omitempty"`
+	DimensionSet string `json:"dimensionSet,omitempty"`
+	// CollectionName is the name of a serverless collection, unless its
+	// metrics have NoCollectionName.
+	CollectionName   string `json:"collectionName,omitempty"`
+	NoCollectionName bool   `json:"noCollectionName,omitempty"`
+	// MetricNames are the metrics ListMetrics found at DiscoveredAt, a Unix time.
+	MetricNames  []string `json:"metricNames,omitempty"`
+	DiscoveredAt int64    `json:"discoveredAt,omitempty"`
+}
+
+func (st pluginState) equal(o pluginState) bool {
+	return st.Key == o.Key && st.Engine == o.Engine && st.EngineRuns == o.EngineRuns && st.DimensionSet == o.DimensionSet && st.CollectionName == o.CollectionName && st.NoCollectionName == o.NoCollectionName &&
+		slices.Equal(st.MetricNames, o.MetricNames) && st.DiscoveredAt == o.DiscoveredAt
+}
+
+// flagsKey identifies the values of the flags in effect once the environment
+// and -config were applied, which the caches are keyed on: what was looked up
+// with other credentials, another role or another domain must not be used.
+func flagsKey(fs *flag.FlagSet) string {
+	var args []string
+	fs.Visit(func(f *flag.Flag) {
+		args = append(args, "-"+f.Name+"="+f.Value.String())
+	})
+	return fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(args, " "))))
+}
+
+// stateFilePath returns the file the state of the domain is cached in, next
+// to the tempfile when one is given.
+func stateFilePath(tempfile string, key string, domain string) string {
+	if tempfile != "" {
+		return tempfile + "." + sanitizeKey(domain) + ".state"
+	}
+	return filepath.Join(pluginutil.PluginWorkDir(), fmt.Sprintf(
+		"mackerel-plugin-aws-elasticsearch-%s.%s.state",
+		key,
+		sanitizeKey(domain),
+	))
+}
+
+// loadState reads the state cached with key. A missing or broken file, or
+// one cached with other flags, yields an empty state.
+func loadState(path string, key string) pluginState {
+	var st pluginState
+	if !readJSONFile(path, &st) || st.Key != key {
+		return pluginState{Key: key}
+	}
+	return st
+}
+
+func saveState(path string, st pluginState) error {
+	return writeJSONFile(path, st)
+}
+
+// lookupRefreshRuns is how many runs the cached lookups are used for before
+// they are made again.
+const lookupRefreshRuns = 60
+
+// lookupCache keeps what is detected with a network call every run otherwise,
+// shared by all domains of the invocation.
+type lookupCache struct {
+	// Key is the flagsKey the lookups were made with.
+	Key      string `json:"key,omitempty"`
+	Region   string `json:"region,omitempty"`
+	ClientID string `json:"clientId,omitempty"`
+	Runs     int    `json:"runs"`
+}
+
+func lookupCachePath(tempfile string, key string) string {
+	if tempfile != "" {
+		return tempfile + ".lookups"
+	}
+	return filepath.Join(pluginutil.PluginWorkDir(), fmt.Sprintf(
+		"mackerel-plugin-aws-elasticsearch-%s.lookups",
+		key,
+	))
+}
+
+// loadLookupCache reads the cache made with key and counts the current run.
+// Once lookupRefreshRuns runs used it, or when it was made with other flags,
+// an empty cache is returned so that everything is looked up again.
+func loadLookupCache(path string, key string) lookupCache {
+	var c lookupCache
+	if !readJSONFile(path, &c) || c.Runs >= lookupRefreshRuns || c.Key != key {
+		c = lookupCache{Key: key}
+	}
+	c.Runs++
+	return c
+}
+
+func saveLookupCache(path string, c lookupCache) error {
+	return writeJSONFile(path, c)
+}
+
+func readJSONFile(path string, v any) bool {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(b, v) == nil
+}
+
+func writeJSONFile(path string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}